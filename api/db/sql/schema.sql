@@ -4,7 +4,8 @@
 CREATE TABLE users(
   id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
   email TEXT NOT NULL UNIQUE CHECK(email ~ '^[a-zA-Z0-9_%+-]+@[a-zA-Z0-9-]+\.[a-zA-Z0-9][a-zA-Z0-9]+$'),
-  password VARCHAR(128) NOT NULL
+  password VARCHAR(128) NOT NULL,
+  username VARCHAR(32) UNIQUE -- lowercase, part of the urls of public feeds
 );
 
 CREATE UNIQUE INDEX idx_users_email ON users(lower(email));
@@ -24,12 +25,38 @@ CREATE TABLE feeds(
   date_created TIMESTAMP NOT NULL DEFAULT timeofday()::TIMESTAMP,
   link TEXT NOT NULL CHECK (link != ''),
   title TEXT NOT NULL CHECK (link != ''),
-  description TEXT
+  description TEXT,
+  image_url TEXT,
+  author TEXT,
+  category TEXT,
+  explicit BOOLEAN NOT NULL DEFAULT false,
+  query jsonb, -- set for smart feeds, whose items are selected from the owner's other feeds
+  read_token VARCHAR(256), -- token embedded in the links between feed documents
+  max_items INT CHECK (max_items > 0), -- items in the live document, older ones being archived
+  newest_first BOOLEAN NOT NULL DEFAULT false,
+  no_full_text BOOLEAN NOT NULL DEFAULT false,
+  hide_dead_links BOOLEAN NOT NULL DEFAULT false,
+  snapshots BOOLEAN NOT NULL DEFAULT false,
+  track_clicks BOOLEAN NOT NULL DEFAULT false, -- item links of feed documents go through the api
+  public BOOLEAN NOT NULL DEFAULT false, -- served without token at /p/:username/:slug
+  slug VARCHAR(64),
+  email_token VARCHAR(64) -- local part of the secret address that adds items by email
 );
 CREATE INDEX idx_feeds_owner_id ON feeds(owner_id);
 CREATE INDEX idx_feeds_id_owner_id ON feeds(id, owner_id);
 CREATE UNIQUE INDEX idx_feeds_owner_id_name ON feeds(owner_id, lower(title));
 CREATE UNIQUE INDEX idx_feeds_owner_id_link ON feeds(owner_id, lower(link));
+CREATE UNIQUE INDEX idx_feeds_email_token ON feeds(email_token) WHERE email_token IS NOT NULL;
+CREATE UNIQUE INDEX idx_feeds_owner_id_slug ON feeds(owner_id, slug) WHERE slug IS NOT NULL;
+
+-- former slugs of feeds, which redirect to their current one
+CREATE TABLE feed_slug_history(
+  owner_id uuid REFERENCES users(id) NOT NULL,
+  slug VARCHAR(64) NOT NULL,
+  feed_id uuid REFERENCES feeds(id) ON DELETE CASCADE NOT NULL,
+  date_created TIMESTAMP NOT NULL DEFAULT timeofday()::TIMESTAMP,
+  PRIMARY KEY (owner_id, slug)
+);
 
 
 CREATE TABLE feed_items(
@@ -39,9 +66,142 @@ CREATE TABLE feed_items(
   date_added TIMESTAMP NOT NULL DEFAULT timeofday()::TIMESTAMP,
   date_modified TIMESTAMP NOT NULL DEFAULT timeofday()::TIMESTAMP,
   link TEXT NOT NULL CHECK (link != ''),
+  normalized_link TEXT NOT NULL, -- link after following redirects, to detect duplicates
   title TEXT NOT NULL CHECK (link != ''),
-  description TEXT
+  description TEXT,
+  enclosure_url TEXT,
+  enclosure_type TEXT,
+  enclosure_length BIGINT,
+  canonical_url TEXT,
+  site_name TEXT,
+  content_html TEXT,
+  guid TEXT, -- identifier of items copied from an upstream feed
+  link_state VARCHAR(16), -- ok, redirected or broken, NULL until the link is checked
+  link_status INT, -- http status of the last link check
+  link_final_url TEXT,
+  link_error TEXT,
+  link_failures INT NOT NULL DEFAULT 0, -- failed checks in a row
+  link_checked TIMESTAMP,
+  link_next_check TIMESTAMP NOT NULL DEFAULT NOW(),
+  snapshot_key TEXT -- blob of the archived copy of the page
 );
 CREATE INDEX idx_feed_items_feed_id ON feed_items(feed_id);
+CREATE INDEX idx_feed_items_owner_id ON feed_items(owner_id);
 CREATE INDEX idx_feed_items_id_owner_id ON feed_items(id, owner_id);
-CREATE UNIQUE INDEX idx_feeds_id_url ON feed_items(id, link);
+CREATE INDEX idx_feed_items_owner_id_normalized_link ON feed_items(owner_id, normalized_link);
+CREATE INDEX idx_feed_items_owner_id_link ON feed_items(owner_id, link);
+CREATE UNIQUE INDEX idx_feed_items_feed_id_normalized_link ON feed_items(feed_id, normalized_link);
+CREATE UNIQUE INDEX idx_feed_items_feed_id_guid ON feed_items(feed_id, guid) WHERE guid IS NOT NULL;
+CREATE INDEX idx_feed_items_link_next_check ON feed_items(link_next_check);
+
+CREATE TABLE feed_item_tags(
+  item_id uuid REFERENCES feed_items(id) ON DELETE CASCADE NOT NULL,
+  owner_id uuid REFERENCES users(id) NOT NULL,
+  tag TEXT NOT NULL CHECK (tag != ''),
+  PRIMARY KEY (item_id, tag)
+);
+CREATE INDEX idx_feed_item_tags_owner_id_tag ON feed_item_tags(owner_id, tag);
+
+-- upstream rss/atom feeds whose entries are copied into a feed
+CREATE TABLE feed_sources(
+  id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+  feed_id uuid REFERENCES feeds(id) ON DELETE CASCADE NOT NULL,
+  owner_id uuid REFERENCES users(id) NOT NULL,
+  date_created TIMESTAMP NOT NULL DEFAULT timeofday()::TIMESTAMP,
+  url TEXT NOT NULL CHECK (url != ''),
+  include_keywords jsonb NOT NULL DEFAULT '[]',
+  exclude_keywords jsonb NOT NULL DEFAULT '[]',
+  etag TEXT,
+  last_modified TEXT,
+  last_polled TIMESTAMP,
+  last_error TEXT,
+  error_count INT NOT NULL DEFAULT 0,
+  next_poll TIMESTAMP NOT NULL DEFAULT timeofday()::TIMESTAMP
+);
+CREATE INDEX idx_feed_sources_feed_id_owner_id ON feed_sources(feed_id, owner_id);
+CREATE INDEX idx_feed_sources_next_poll ON feed_sources(next_poll);
+CREATE UNIQUE INDEX idx_feed_sources_feed_id_url ON feed_sources(feed_id, url);
+
+-- guids of the entries seen in a source, which outlive the items they were
+-- copied into so that deleted items stay deleted
+CREATE TABLE feed_source_guids(
+  source_id uuid REFERENCES feed_sources(id) ON DELETE CASCADE NOT NULL,
+  guid TEXT NOT NULL,
+  PRIMARY KEY (source_id, guid)
+);
+
+-- websub subscribers of feed documents, the topic being the url of a document
+CREATE TABLE websub_subscriptions(
+  id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+  feed_id uuid REFERENCES feeds(id) ON DELETE CASCADE NOT NULL,
+  date_created TIMESTAMP NOT NULL DEFAULT timeofday()::TIMESTAMP,
+  topic TEXT NOT NULL,
+  callback TEXT NOT NULL,
+  secret TEXT, -- key of the signature of distributed content
+  lease_expires TIMESTAMP NOT NULL
+);
+CREATE INDEX idx_websub_subscriptions_feed_id ON websub_subscriptions(feed_id);
+CREATE INDEX idx_websub_subscriptions_lease_expires ON websub_subscriptions(lease_expires);
+CREATE UNIQUE INDEX idx_websub_subscriptions_topic_callback ON websub_subscriptions(topic, callback);
+
+-- endpoints receiving the changes of a feed, or of all the feeds of a user
+CREATE TABLE webhooks(
+  id uuid PRIMARY KEY,
+  owner_id uuid REFERENCES users(id) NOT NULL,
+  feed_id uuid REFERENCES feeds(id) ON DELETE CASCADE, -- all the feeds of the owner if null
+  date_created TIMESTAMP NOT NULL DEFAULT timeofday()::TIMESTAMP,
+  url TEXT NOT NULL,
+  events jsonb NOT NULL DEFAULT '[]', -- all the events if empty
+  secret TEXT NOT NULL
+);
+CREATE INDEX idx_webhooks_owner_id ON webhooks(owner_id);
+
+CREATE TABLE webhook_deliveries(
+  id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+  webhook_id uuid REFERENCES webhooks(id) ON DELETE CASCADE NOT NULL,
+  owner_id uuid NOT NULL,
+  date_created TIMESTAMP NOT NULL DEFAULT timeofday()::TIMESTAMP,
+  event VARCHAR(32) NOT NULL,
+  payload TEXT NOT NULL,
+  status VARCHAR(16) NOT NULL DEFAULT 'pending', -- pending, delivered or failed
+  attempts INT NOT NULL DEFAULT 0,
+  last_status INT,
+  last_error TEXT,
+  last_attempt TIMESTAMP,
+  next_attempt TIMESTAMP NOT NULL DEFAULT timeofday()::TIMESTAMP
+);
+CREATE INDEX idx_webhook_deliveries_webhook_id_date_created ON webhook_deliveries(webhook_id, date_created);
+CREATE INDEX idx_webhook_deliveries_next_attempt ON webhook_deliveries(next_attempt) WHERE status = 'pending';
+CREATE INDEX idx_webhook_deliveries_date_created ON webhook_deliveries(date_created);
+
+-- links of the builtin url shortener, served at /s/:code
+CREATE TABLE short_links(
+  code VARCHAR(16) PRIMARY KEY,
+  url TEXT NOT NULL,
+  date_created TIMESTAMP NOT NULL DEFAULT timeofday()::TIMESTAMP
+);
+CREATE UNIQUE INDEX idx_short_links_url ON short_links(url);
+
+-- clicks on the item links of feeds that track them
+CREATE TABLE item_clicks(
+  id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+  feed_id uuid REFERENCES feeds(id) ON DELETE CASCADE NOT NULL, -- the feed the link was clicked in
+  item_id uuid REFERENCES feed_items(id) ON DELETE CASCADE NOT NULL,
+  owner_id uuid NOT NULL,
+  date_clicked TIMESTAMP NOT NULL DEFAULT timeofday()::TIMESTAMP,
+  referrer TEXT,
+  user_agent VARCHAR(32) NOT NULL -- family of the user agent
+);
+CREATE INDEX idx_item_clicks_feed_id_item_id ON item_clicks(feed_id, item_id);
+
+-- daily rollups of the fetches of feed documents, by client
+CREATE TABLE feed_fetch_stats(
+  feed_id uuid REFERENCES feeds(id) ON DELETE CASCADE NOT NULL,
+  day DATE NOT NULL,
+  token_hash VARCHAR(16) NOT NULL, -- hash of the token the client authenticated with
+  user_agent TEXT NOT NULL, -- with the number of subscribers it reports replaced by N
+  fetches INT NOT NULL DEFAULT 0,
+  not_modified INT NOT NULL DEFAULT 0,
+  reported_subscribers INT,
+  PRIMARY KEY (feed_id, day, token_hash, user_agent)
+);
@@ -1,20 +1,173 @@
 
 
-CREATE OR REPLACE VIEW feed_json AS SELECT
-  id, owner_id, date_created, row_to_json(feed_json) as json
+DROP FUNCTION IF EXISTS feed_xml(uuid, uuid);
+DROP FUNCTION IF EXISTS feed_atom(uuid, uuid);
+DROP FUNCTION IF EXISTS feed_jsonfeed(uuid, uuid);
+DROP FUNCTION IF EXISTS feed_xml(uuid, uuid, text);
+DROP FUNCTION IF EXISTS feed_atom(uuid, uuid, text);
+DROP FUNCTION IF EXISTS feed_jsonfeed(uuid, uuid, text);
+DROP VIEW IF EXISTS feeds_json;
+DROP VIEW IF EXISTS feed_json;
+DROP FUNCTION IF EXISTS feed_json_object(feeds, text);
+DROP FUNCTION IF EXISTS json_without_nulls(json);
+
+CREATE OR REPLACE FUNCTION url_encode(TEXT) RETURNS TEXT AS $$
+  SELECT string_agg(
+    CASE WHEN ch ~ '^[A-Za-z0-9_.~-]$' THEN ch
+    ELSE regexp_replace(upper(encode(convert_to(ch, 'UTF8'), 'hex')), '(..)', '%\1', 'g') END,
+    '' ORDER BY idx)
+  FROM regexp_split_to_table($1, '') WITH ORDINALITY AS chars(ch, idx)
+$$ IMMUTABLE LANGUAGE SQL;
+
+CREATE OR REPLACE FUNCTION link_host(TEXT) RETURNS TEXT AS $$
+  SELECT lower(substring($1 from '^[a-zA-Z][a-zA-Z0-9+.-]*://(?:[^@/]*@)?([^:/?#]+)'))
+$$ IMMUTABLE LANGUAGE SQL;
+
+-- whether an item matches the saved query of a smart feed. Every criterion
+-- present in the query must match: tag, feedIDs, maxAgeDays and domain.
+CREATE OR REPLACE FUNCTION smart_query_matches(jsonb, feed_items) RETURNS BOOLEAN AS $$
+  SELECT
+    ($1->>'tag' IS NULL OR EXISTS (
+      SELECT 1 FROM feed_item_tags WHERE feed_item_tags.item_id=($2).id AND feed_item_tags.tag=lower($1->>'tag')
+    ))
+    AND ($1->'feedIDs' IS NULL OR ($2).feed_id IN (SELECT jsonb_array_elements_text($1->'feedIDs')::uuid))
+    AND ($1->>'maxAgeDays' IS NULL OR ($2).date_added > now() - ($1->>'maxAgeDays')::int * interval '1 day')
+    AND ($1->>'domain' IS NULL OR link_host(($2).link) = lower($1->>'domain') OR link_host(($2).link) LIKE '%.' || lower($1->>'domain'))
+$$ STABLE LANGUAGE SQL;
+
+-- items of a feed, optionally restricted to those having the given tag.
+-- Smart feeds have no items of their own: theirs are selected by their
+-- saved query among all the items of their owner.
+CREATE OR REPLACE FUNCTION feed_entries(uuid, text) RETURNS SETOF feed_items AS $$
+  SELECT * FROM (
+    SELECT * FROM feed_items WHERE feed_id=$1
+    UNION ALL
+    SELECT feed_items.* FROM feeds INNER JOIN feed_items ON feed_items.owner_id=feeds.owner_id
+      WHERE feeds.id=$1 AND feeds.query IS NOT NULL AND smart_query_matches(feeds.query, feed_items)
+  ) AS feed_items
+    WHERE ($2 IS NULL OR EXISTS (
+      SELECT 1 FROM feed_item_tags WHERE feed_item_tags.item_id=feed_items.id AND feed_item_tags.tag=lower($2)
+    ))
+    ORDER BY date_added ASC
+$$ STABLE LANGUAGE SQL;
+
+CREATE OR REPLACE FUNCTION feed_archive_count(feeds, text) RETURNS INT AS $$
+  SELECT CASE WHEN ($1).max_items IS NULL THEN 0 ELSE greatest((count(*)::int - 1) / ($1).max_items, 0) END
+  FROM feed_entries(($1).id, $2) AS item
+  WHERE NOT (($1).hide_dead_links AND item.link_state IS NOT DISTINCT FROM 'broken')
+$$ STABLE LANGUAGE SQL;
+
+-- items of a feed document, given its options (tag, page). The live document
+-- has the newest max_items items; older ones are in fixed-size RFC 5005 archive
+-- pages, numbered from 1 for the oldest. Items with a broken link are left out
+-- of feeds that hide dead links.
+CREATE OR REPLACE FUNCTION feed_document_entries(feeds, json) RETURNS SETOF feed_items AS $$
+  SELECT (ranked.item).* FROM (
+    SELECT item, row_number() OVER (ORDER BY (item).date_added ASC) AS rank, count(*) OVER () AS total
+    FROM feed_entries(($1).id, $2->>'tag') AS item
+    WHERE NOT (($1).hide_dead_links AND (item).link_state IS NOT DISTINCT FROM 'broken')
+  ) AS ranked
+  WHERE ($1).max_items IS NULL
+    OR (coalesce(($2->>'page')::int, 0) = 0 AND ranked.rank > ranked.total - ($1).max_items)
+    OR (ranked.rank > (($2->>'page')::int - 1) * ($1).max_items AND ranked.rank <= ($2->>'page')::int * ($1).max_items)
+  ORDER BY
+    CASE WHEN ($1).newest_first THEN (ranked.item).date_added END DESC,
+    (ranked.item).date_added ASC
+$$ STABLE LANGUAGE SQL;
+
+-- absolute url of a feed document in the given format, or NULL if it can't be built
+CREATE OR REPLACE FUNCTION feed_document_url(feeds, json, text, int) RETURNS TEXT AS $$
+  SELECT CASE WHEN $2->>'publicURL' IS NOT NULL THEN
+    -- public documents are named after the slug, and need no token
+    rtrim(($2->>'publicURL') || '.' || replace($3, 'feed.json', 'json') || '?'
+      || coalesce('tag=' || url_encode($2->>'tag') || '&', '')
+      || CASE WHEN $4 > 0 THEN 'page=' || $4 ELSE '' END, '?&')
+  ELSE
+    ($2->>'baseURL') || '/feeds/' || REPLACE(($1).id::text, '-', '') || '/' || $3
+      || '?_tok=' || url_encode(($1).read_token)
+      || coalesce('&tag=' || url_encode($2->>'tag'), '')
+      || CASE WHEN $4 > 0 THEN '&page=' || $4 ELSE '' END
+  END
+$$ STABLE LANGUAGE SQL;
+
+-- link to the feed itself: its public rss document if it is served publicly,
+-- since its own link embeds its token
+CREATE OR REPLACE FUNCTION feed_link(feeds, json) RETURNS TEXT AS $$
+  SELECT coalesce(($2->>'publicURL') || '.rss', ($1).link)
+$$ STABLE LANGUAGE SQL;
+
+-- absolute url of the archived copy of the page of an item, or NULL if there
+-- is none or if the feed is served publicly, since it requires the token
+CREATE OR REPLACE FUNCTION feed_item_snapshot_url(feeds, json, feed_items) RETURNS TEXT AS $$
+  SELECT CASE WHEN ($3).snapshot_key IS NOT NULL AND $2->>'publicURL' IS NULL THEN
+    ($2->>'baseURL') || '/feeds/' || REPLACE(($1).id::text, '-', '') || '/items/' || REPLACE(($3).id::text, '-', '')
+      || '/snapshot?_tok=' || url_encode(($1).read_token)
+  END
+$$ STABLE LANGUAGE SQL;
+
+-- link of an item in the feed documents: the api endpoint that counts its
+-- clicks, if the feed tracks them
+CREATE OR REPLACE FUNCTION feed_item_link(feeds, json, feed_items) RETURNS TEXT AS $$
+  SELECT coalesce(CASE WHEN ($1).track_clicks THEN
+    ($2->>'baseURL') || '/feeds/' || REPLACE(($1).id::text, '-', '') || '/items/' || REPLACE(($3).id::text, '-', '') || '/click'
+  END, ($3).link)
+$$ STABLE LANGUAGE SQL;
+
+-- RFC 5005 links from a feed document to the other documents of its archive
+CREATE OR REPLACE FUNCTION feed_archive_links(feeds, json, text) RETURNS TABLE(link_rel text, link_href text) AS $$
+  SELECT links.rel, feed_document_url($1, $2, $3, links.page)
+  FROM
+    (SELECT coalesce(($2->>'page')::int, 0) AS page, feed_archive_count($1, $2->>'tag') AS archives) AS doc,
+    LATERAL (VALUES
+      ('current', CASE WHEN doc.page > 0 THEN 0 END),
+      ('prev-archive', CASE WHEN doc.page = 0 AND doc.archives > 0 THEN doc.archives WHEN doc.page > 1 THEN doc.page - 1 END),
+      ('next-archive', CASE WHEN doc.page > 0 AND doc.page < doc.archives THEN doc.page + 1 END)
+    ) AS links(rel, page)
+  WHERE links.page IS NOT NULL AND feed_document_url($1, $2, $3, links.page) IS NOT NULL
+$$ STABLE LANGUAGE SQL;
+
+-- WebSub links of a live feed document: its hub, and itself as the topic to
+-- subscribe to. Topics are documents with a token, so public documents only
+-- link to themselves, and feeds created before they had a read token, which
+-- have no topic to subscribe to, link to no hub.
+CREATE OR REPLACE FUNCTION feed_websub_links(feeds, json, text) RETURNS TABLE(link_rel text, link_href text) AS $$
+  SELECT links.rel, links.href
+  FROM (VALUES
+    ('hub', CASE WHEN $2->>'publicURL' IS NULL AND ($1).read_token IS NOT NULL THEN ($2->>'baseURL') || '/hub' END),
+    ('self', feed_document_url($1, $2, $3, 0))
+  ) AS links(rel, href)
+  WHERE coalesce(($2->>'page')::int, 0) = 0 AND links.href IS NOT NULL
+$$ STABLE LANGUAGE SQL;
+
+CREATE OR REPLACE FUNCTION feed_item_tag_list(uuid) RETURNS text[] AS $$
+  SELECT COALESCE(array_agg(tag ORDER BY tag), '{}') FROM feed_item_tags WHERE item_id=$1
+$$ STABLE LANGUAGE SQL;
+
+CREATE OR REPLACE FUNCTION feed_json_object(feeds, json) RETURNS json AS $$
+  SELECT row_to_json(feed_json)
   FROM (
-    SELECT REPLACE(id::text, '-', '') as id, owner_id,date_created, title, link,
+    SELECT REPLACE(($1).id::text, '-', '') as id, ($1).owner_id, ($1).date_created, ($1).title, ($1).link,
+      ($1).image_url as "imageURL", ($1).author, ($1).category, ($1).explicit, ($1).query,
+      ($1).max_items as "maxItems", ($1).newest_first as "newestFirst", ($1).no_full_text as "noFullText",
+      ($1).hide_dead_links as "hideDeadLinks", ($1).snapshots, ($1).track_clicks as "trackClicks",
+      ($1).public, ($1).slug,
       (
         SELECT COALESCE(array_to_json(array_agg(row_to_json(d))), '[]')
         FROM (
-          SELECT REPLACE(id::text, '-', '') as id, link, title, description, date_added, date_modified
-          FROM feed_items
-          WHERE feed_id=feeds.id
-          ORDER BY date_added ASC
+          SELECT REPLACE(id::text, '-', '') as id, REPLACE(feed_id::text, '-', '') as "feedID",
+            link, title, description, date_added, date_modified,
+            enclosure_url as "enclosureURL", enclosure_type as "enclosureType", enclosure_length as "enclosureLength",
+            feed_item_tag_list(id) as tags, canonical_url as "canonicalURL", site_name as "siteName",
+            content_html as "contentHTML"
+          FROM feed_document_entries($1, $2)
         ) d
       ) as items
-  FROM feeds
   ) feed_json
+$$ STABLE LANGUAGE SQL;
+
+CREATE OR REPLACE VIEW feed_json AS SELECT
+  id, owner_id, date_created, feed_json_object(feeds, '{}') as json
+  FROM feeds
 ;
 
 CREATE OR REPLACE VIEW feeds_json AS
@@ -24,30 +177,181 @@ CREATE OR REPLACE VIEW feeds_json AS
   ) AS feeds GROUP BY owner_id
 ;
 
-CREATE OR REPLACE FUNCTION feed_xml(uuid, uuid) RETURNS xml AS $$
+CREATE OR REPLACE FUNCTION feed_xml(uuid, uuid, json) RETURNS xml AS $$
   SELECT
     xmlelement(name "rss",
-      xmlattributes('2.0' as "version"),
+      xmlattributes(
+        '2.0' as "version",
+        'http://www.itunes.com/dtds/podcast-1.0.dtd' as "xmlns:itunes",
+        'http://www.w3.org/2005/Atom' as "xmlns:atom",
+        'http://purl.org/syndication/history/1.0' as "xmlns:fh",
+        'http://purl.org/rss/1.0/modules/content/' as "xmlns:content"
+      ),
       xmlelement(name "channel",
-        xmlelement(name "link", feeds.link),
+        xmlelement(name "link", feed_link(feeds, $3)),
         xmlelement(name "title", feeds.title),
         xmlelement(name "description", coalesce(nullif(feeds.description, ''), feeds.title)),
+        CASE WHEN ($3->>'page')::int > 0 THEN xmlelement(name "fh:archive") END,
+        (SELECT xmlagg(xmlelement(name "atom:link", xmlattributes(link_rel as "rel", link_href as "href")))
+          FROM (SELECT * FROM feed_archive_links(feeds, $3, 'rss') UNION ALL SELECT * FROM feed_websub_links(feeds, $3, 'rss')) AS links),
+        CASE WHEN feeds.author IS NOT NULL THEN xmlelement(name "itunes:author", feeds.author) END,
+        CASE WHEN feeds.image_url IS NOT NULL THEN xmlelement(name "itunes:image", xmlattributes(feeds.image_url as "href")) END,
+        CASE WHEN feeds.category IS NOT NULL THEN xmlelement(name "itunes:category", xmlattributes(feeds.category as "text")) END,
+        xmlelement(name "itunes:explicit", CASE WHEN feeds.explicit THEN 'true' ELSE 'false' END),
         (SELECT xmlagg(xmlelement(
               name item,
-              xmlelement(name "link", feed_items.link),
+              xmlelement(name "link", feed_item_link(feeds, $3, feed_items)),
               xmlelement(name "title", feed_items.title),
-              xmlelement(name "guid", feeds.link || '/items/' || feed_items.id ),
-              xmlelement(name "pubDate", (SELECT to_char(feed_items.date_added, 'Dy, DD Mon YYYY HH24:MI:SS ') || 'GMT'))
+              xmlelement(name "guid", coalesce($3->>'publicURL', feeds.link) || '/items/' || feed_items.id ),
+              xmlelement(name "pubDate", (SELECT to_char(feed_items.date_added, 'Dy, DD Mon YYYY HH24:MI:SS ') || 'GMT')),
+              (SELECT xmlagg(xmlelement(name "category", tag)) FROM unnest(feed_item_tag_list(feed_items.id)) AS tag),
+              CASE WHEN feed_items.content_html IS NOT NULL AND NOT feeds.no_full_text THEN
+                xmlelement(name "content:encoded", feed_items.content_html) END,
+              CASE WHEN feed_item_snapshot_url(feeds, $3, feed_items) IS NOT NULL THEN xmlelement(name "atom:link", xmlattributes(
+                'alternate' as "rel", 'text/html' as "type", 'Archived copy' as "title",
+                feed_item_snapshot_url(feeds, $3, feed_items) as "href"
+              )) END,
+              CASE WHEN feed_items.enclosure_url IS NOT NULL THEN xmlelement(name "enclosure", xmlattributes(
+                feed_items.enclosure_url as "url",
+                coalesce(feed_items.enclosure_length, 0) as "length",
+                coalesce(feed_items.enclosure_type, 'application/octet-stream') as "type"
+              )) END
+            ))
+            FROM feed_document_entries(feeds, $3) as feed_items
+        )
+      )
+    ) as xml
+  FROM feeds WHERE feeds.id=$1 AND feeds.owner_id=$2
+    AND coalesce(($3->>'page')::int, 0) BETWEEN 0 AND feed_archive_count(feeds, $3->>'tag')
+$$ LANGUAGE SQL;
+
+CREATE OR REPLACE FUNCTION atom_date(TIMESTAMP) RETURNS TEXT AS $$
+  SELECT to_char($1, 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+$$ IMMUTABLE LANGUAGE SQL;
+
+-- author of a feed when it names none: the owner's username in public
+-- documents, which must not disclose their email, and the local part of their
+-- email otherwise
+CREATE OR REPLACE FUNCTION feed_author_name(feeds, users, json) RETURNS TEXT AS $$
+  SELECT coalesce(($1).author, CASE WHEN $3->>'publicURL' IS NOT NULL THEN ($2).username
+    ELSE split_part(($2).email, '@', 1) END)
+$$ STABLE LANGUAGE SQL;
+
+CREATE OR REPLACE FUNCTION feed_atom(uuid, uuid, json) RETURNS xml AS $$
+  SELECT
+    xmlelement(name "feed",
+      xmlattributes('http://www.w3.org/2005/Atom' as "xmlns", 'http://purl.org/syndication/history/1.0' as "xmlns:fh"),
+      xmlelement(name "id", 'urn:uuid:' || feeds.id),
+      xmlelement(name "title", feeds.title),
+      xmlelement(name "subtitle", coalesce(nullif(feeds.description, ''), feeds.title)),
+      xmlelement(name "link", xmlattributes('alternate' as "rel", 'application/rss+xml' as "type", feed_link(feeds, $3) as "href")),
+      CASE WHEN ($3->>'page')::int > 0 THEN xmlelement(name "fh:archive") END,
+      (SELECT xmlagg(xmlelement(name "link", xmlattributes(link_rel as "rel", link_href as "href")))
+        FROM (SELECT * FROM feed_archive_links(feeds, $3, 'atom') UNION ALL SELECT * FROM feed_websub_links(feeds, $3, 'atom')) AS links),
+      xmlelement(name "updated", atom_date(
+        (SELECT greatest(feeds.date_created, max(date_modified)) FROM feed_items WHERE feed_id=feeds.id)
+      )),
+      xmlelement(name "author",
+        xmlelement(name "name", feed_author_name(feeds, users, $3)),
+        CASE WHEN $3->>'publicURL' IS NULL THEN xmlelement(name "email", users.email) END
+      ),
+      CASE WHEN feeds.category IS NOT NULL THEN xmlelement(name "category", xmlattributes(feeds.category as "term")) END,
+      CASE WHEN feeds.image_url IS NOT NULL THEN xmlelement(name "logo", feeds.image_url) END,
+      (SELECT xmlagg(xmlelement(
+            name entry,
+            xmlelement(name "id", 'urn:uuid:' || feed_items.id),
+            xmlelement(name "title", feed_items.title),
+            xmlelement(name "link", xmlattributes(feed_item_link(feeds, $3, feed_items) as "href")),
+            CASE WHEN feed_item_snapshot_url(feeds, $3, feed_items) IS NOT NULL THEN xmlelement(name "link", xmlattributes(
+              'alternate' as "rel", 'text/html' as "type", 'Archived copy' as "title",
+              feed_item_snapshot_url(feeds, $3, feed_items) as "href"
+            )) END,
+            CASE WHEN feed_items.enclosure_url IS NOT NULL THEN xmlelement(name "link", xmlattributes(
+              'enclosure' as "rel",
+              feed_items.enclosure_url as "href",
+              feed_items.enclosure_type as "type",
+              feed_items.enclosure_length as "length"
+            )) END,
+            xmlelement(name "published", atom_date(feed_items.date_added)),
+            xmlelement(name "updated", atom_date(feed_items.date_modified)),
+            xmlelement(name "summary", coalesce(nullif(feed_items.description, ''), feed_items.title)),
+            CASE WHEN feed_items.content_html IS NOT NULL AND NOT feeds.no_full_text THEN
+              xmlelement(name "content", xmlattributes('html' as "type"), feed_items.content_html) END,
+            (SELECT xmlagg(xmlelement(name "category", xmlattributes(tag as "term"))) FROM unnest(feed_item_tag_list(feed_items.id)) AS tag)
+          ))
+          FROM feed_document_entries(feeds, $3) as feed_items
+      )
+    ) as xml
+  FROM feeds INNER JOIN users ON users.id = feeds.owner_id
+  WHERE feeds.id=$1 AND feeds.owner_id=$2
+    AND coalesce(($3->>'page')::int, 0) BETWEEN 0 AND feed_archive_count(feeds, $3->>'tag')
+$$ LANGUAGE SQL;
+
+CREATE OR REPLACE FUNCTION feed_jsonfeed(uuid, uuid, json) RETURNS json AS $$
+  SELECT
+    json_strip_nulls(json_build_object(
+      'version', 'https://jsonfeed.org/version/1.1',
+      'title', feeds.title,
+      'description', coalesce(nullif(feeds.description, ''), feeds.title),
+      'icon', feeds.image_url,
+      'next_url', (SELECT link_href FROM feed_archive_links(feeds, $3, 'feed.json') WHERE link_rel = 'prev-archive'),
+      'feed_url', (SELECT link_href FROM feed_websub_links(feeds, $3, 'feed.json') WHERE link_rel = 'self'),
+      'hubs', (SELECT json_agg(json_build_object('type', 'WebSub', 'url', link_href))
+        FROM feed_websub_links(feeds, $3, 'feed.json') WHERE link_rel = 'hub'),
+      'authors', json_build_array(json_build_object('name', feed_author_name(feeds, users, $3))),
+      'items', (
+        SELECT COALESCE(json_agg(json_build_object(
+            'id', REPLACE(feed_items.id::text, '-', ''),
+            'url', feed_item_link(feeds, $3, feed_items),
+            'title', feed_items.title,
+            'content_text', coalesce(nullif(feed_items.description, ''), feed_items.title),
+            'content_html', CASE WHEN NOT feeds.no_full_text THEN feed_items.content_html END,
+            'date_published', atom_date(feed_items.date_added),
+            'date_modified', atom_date(feed_items.date_modified),
+            'tags', array_to_json(nullif(feed_item_tag_list(feed_items.id), '{}')),
+            'attachments', CASE WHEN feed_items.enclosure_url IS NOT NULL THEN json_build_array(json_build_object(
+              'url', feed_items.enclosure_url,
+              'mime_type', coalesce(feed_items.enclosure_type, 'application/octet-stream'),
+              'size_in_bytes', feed_items.enclosure_length
+            )) END
+          )), '[]')
+          FROM feed_document_entries(feeds, $3) as feed_items
+      )
+    )) as json
+  FROM feeds INNER JOIN users ON users.id = feeds.owner_id
+  WHERE feeds.id=$1 AND feeds.owner_id=$2
+    AND coalesce(($3->>'page')::int, 0) BETWEEN 0 AND feed_archive_count(feeds, $3->>'tag')
+$$ LANGUAGE SQL;
+
+CREATE OR REPLACE FUNCTION feeds_opml(uuid) RETURNS xml AS $$
+  SELECT
+    xmlelement(name "opml",
+      xmlattributes('2.0' as "version"),
+      xmlelement(name "head",
+        xmlelement(name "title", 'myfeeds: ' || users.email),
+        xmlelement(name "dateCreated", (SELECT to_char(now() at time zone 'UTC', 'Dy, DD Mon YYYY HH24:MI:SS ') || 'GMT')),
+        xmlelement(name "ownerEmail", users.email)
+      ),
+      xmlelement(name "body",
+        (SELECT xmlagg(xmlelement(
+              name outline,
+              xmlattributes(
+                'rss' as "type",
+                feeds.title as "text",
+                feeds.title as "title",
+                feeds.link as "xmlUrl",
+                nullif(feeds.description, '') as "description"
+              )
             ))
             FROM (
-              SELECT * FROM feed_items
-                WHERE feed_id=feeds.id
-                ORDER BY date_added ASC
-            ) as feed_items
+              SELECT * FROM feeds
+                WHERE owner_id=users.id
+                ORDER BY date_created ASC
+            ) as feeds
         )
       )
     ) as xml
-  FROM feeds WHERE feeds.id=$1 AND feeds.owner_id=$2 
+  FROM users WHERE users.id=$1
 $$ LANGUAGE SQL;
 
 CREATE OR REPLACE FUNCTION access_token_is_valid(TEXT, access_tokens) RETURNS BOOLEAN AS $$
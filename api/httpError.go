@@ -46,6 +46,27 @@ func httpErrorRecovery(c *MyFeedsContext, w http.ResponseWriter, r *http.Request
 				code = http.StatusNotFound
 			} else if err == services.ErrUniqueViolation {
 				code = http.StatusBadRequest
+			} else if err == services.ErrSmartFeedItems {
+				code = http.StatusBadRequest
+				text = "Smart feeds cannot have items of their own"
+			} else if err == services.ErrDuplicateItem {
+				code = http.StatusConflict
+				text = "Item already in feed"
+			} else if err == services.ErrInvalidSmartQuery {
+				code = http.StatusBadRequest
+				text = "Invalid smart query: feed ids must be ids and the domain a host name"
+			} else if err == services.ErrUnknownTopic {
+				code = http.StatusBadRequest
+				text = "Unknown topic"
+			} else if err == services.ErrInvalidName {
+				code = http.StatusBadRequest
+				text = "Invalid name: use lowercase letters, digits and dashes"
+			} else if err == services.ErrNoUsername {
+				code = http.StatusBadRequest
+				text = "A username is required to make feeds public"
+			} else if err == services.ErrEmailDisabled {
+				code = http.StatusNotFound
+				text = "Inbound email is not enabled"
 			} else {
 				code = http.StatusInternalServerError
 				stack := debug.Stack()
@@ -3,8 +3,14 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/vincentcr/myfeeds/api/services"
 	"github.com/vincentcr/validator"
@@ -26,6 +32,11 @@ func setupServer(svc *services.Services) {
 	setupMiddlewares(m)
 	routeUsers(m)
 	routeFeeds(m)
+	routeHub(m)
+	routeWebhooks(m)
+	routeEvents(m)
+	routeShortLinks(m)
+	routePublicFeeds(m)
 	m.Serve()
 }
 
@@ -37,7 +48,7 @@ func setupMiddlewares(m *Mux) {
 
 func cors(c *MyFeedsContext, w http.ResponseWriter, r *http.Request, next NextFunc) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Authorization,Accept,Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization,Accept,Content-Type,Last-Event-ID")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, HEAD")
 	next()
 }
@@ -47,6 +58,10 @@ type UserRequest struct {
 	Password string `validate:"nonzero,min=6"`
 }
 
+type UsernameRequest struct {
+	Username string `validate:"nonzero"`
+}
+
 func routeUsers(m *Mux) {
 
 	m.Post("/api/v1/users", func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
@@ -79,6 +94,21 @@ func routeUsers(m *Mux) {
 		jsonify(user, w)
 	}))
 
+	m.Put("/api/v1/users/me/username", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		var usernameReq UsernameRequest
+		if err := parseAndValidate(r, &usernameReq); err != nil {
+			panic(err)
+		}
+		user := c.MustGetUser()
+		err := c.Services.Users.SetUsername(&user, usernameReq.Username)
+		if err == services.ErrUniqueViolation {
+			panic(NewHttpErrorWithText(http.StatusBadRequest, "Username already taken"))
+		} else if err != nil {
+			panic(err)
+		}
+		jsonify(user, w)
+	}))
+
 	m.Post("/api/v1/users/tokens", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
 		user := c.MustGetUser()
 		token, err := c.Services.Users.CreateTokenRW(user)
@@ -113,22 +143,78 @@ func routeFeeds(m *Mux) {
 		writeCacheable(r, w, "application/json", feeds)
 	}))
 
+	m.Get("/api/v1/tags", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		tags, err := c.Services.Feeds.GetTags(c.MustGetUser())
+		if err != nil {
+			panic(err)
+		}
+		writeCacheable(r, w, "application/json", tags)
+	}))
+
+	m.Get("/api/v1/items/lookup", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		link := strings.TrimSpace(r.URL.Query().Get("url"))
+		if link == "" {
+			panic(NewHttpErrorWithText(http.StatusBadRequest, "missing url parameter"))
+		}
+		items, err := c.Services.Feeds.LookupItems(c.MustGetUser(), link)
+		if err != nil {
+			panic(err)
+		}
+		writeCacheable(r, w, "application/json", items)
+	}))
+
+	m.Get("/api/v1/feeds.opml", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		opml, err := c.Services.Feeds.GetAllOpml(c.MustGetUser())
+		if err != nil {
+			panic(err)
+		}
+		writeCacheable(r, w, "text/x-opml", opml)
+	}))
+
 	m.Get("/api/v1/feeds/:feedID", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
 		feedID := services.RecordID(c.URLParams["feedID"])
-		feed, err := c.Services.Feeds.GetJson(c.MustGetUser(), feedID)
+		w.Header().Add("Vary", "Accept")
+		rep, ok := negotiateFeedRepresentation(r.Header.Get("Accept"))
+		if !ok {
+			panic(NewHttpError(http.StatusNotAcceptable))
+		}
+		feed, err := c.Services.Feeds.Get(c.MustGetUser(), feedID, rep.format, feedOptionsFromRequest(r))
 		if err != nil {
 			panic(err)
 		}
-		writeCacheable(r, w, "application/json", feed)
+		// the json of the api is not a document readers subscribe to
+		if rep.format == services.FormatJSON {
+			writeCacheable(r, w, rep.contentType, feed)
+		} else {
+			writeFeedDocument(c, r, w, feedID, rep.contentType, feed)
+		}
 	}))
 
 	m.Get("/api/v1/feeds/:feedID/rss", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
 		feedID := services.RecordID(c.URLParams["feedID"])
-		rss, err := c.Services.Feeds.GetRss(c.MustGetUser(), feedID)
+		rss, err := c.Services.Feeds.Get(c.MustGetUser(), feedID, services.FormatRSS, feedOptionsFromRequest(r))
 		if err != nil {
 			panic(err)
 		}
-		writeCacheable(r, w, "text/xml", rss)
+		writeFeedDocument(c, r, w, feedID, "text/xml", rss)
+	}))
+
+	m.Get("/api/v1/feeds/:feedID/atom", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		atom, err := c.Services.Feeds.Get(c.MustGetUser(), feedID, services.FormatAtom, feedOptionsFromRequest(r))
+		if err != nil {
+			panic(err)
+		}
+		writeFeedDocument(c, r, w, feedID, "application/atom+xml", atom)
+	}))
+
+	m.Get("/api/v1/feeds/:feedID/feed.json", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		jsonFeed, err := c.Services.Feeds.Get(c.MustGetUser(), feedID, services.FormatJSONFeed, feedOptionsFromRequest(r))
+		if err != nil {
+			panic(err)
+		}
+		writeFeedDocument(c, r, w, feedID, "application/feed+json", jsonFeed)
 	}))
 
 	m.Post("/api/v1/feeds", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
@@ -151,6 +237,53 @@ func routeFeeds(m *Mux) {
 		jsonify(feed, w)
 	}))
 
+	m.Post("/api/v1/feeds/import", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		body, err := importRequestBody(r)
+		if err != nil {
+			panic(err)
+		}
+		defer body.Close()
+
+		imported, err := services.ParseImport(body)
+		if err != nil {
+			panic(NewHttpErrorWithText(http.StatusBadRequest, err.Error()))
+		}
+
+		user := c.MustGetUser()
+		results := make([]FeedImportResult, 0, len(imported))
+		for _, imp := range imported {
+			results = append(results, importFeed(c, user, imp))
+		}
+		jsonify(results, w)
+	}))
+
+	m.Post("/api/v1/feeds/import/bookmarks", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		body, err := importRequestBody(r)
+		if err != nil {
+			panic(err)
+		}
+		defer body.Close()
+
+		imported, rejected, err := services.ParseBookmarks(body)
+		if err != nil {
+			panic(NewHttpErrorWithText(http.StatusBadRequest, err.Error()))
+		}
+
+		user := c.MustGetUser()
+		summary := BookmarksImportSummary{
+			Feeds:      []BookmarksImportFeed{},
+			Duplicates: []BookmarksImportItem{},
+			Rejected:   []BookmarksImportItem{},
+		}
+		for _, rej := range rejected {
+			summary.Rejected = append(summary.Rejected, BookmarksImportItem{rej.Folder, rej.Link, rej.Title, rej.Reason})
+		}
+		for _, imp := range imported {
+			importBookmarks(c, user, imp.Feed, &summary)
+		}
+		jsonify(summary, w)
+	}))
+
 	m.Put("/api/v1/feeds/:feedID", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
 		feedID := services.RecordID(c.URLParams["feedID"])
 		feed := services.Feed{}
@@ -188,8 +321,9 @@ func routeFeeds(m *Mux) {
 	}))
 
 	m.Put("/api/v1/feeds/:feedID/items/:itemID", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
 		itemID := services.RecordID(c.URLParams["itemID"])
-		item := services.FeedItem{ID: itemID}
+		item := services.FeedItem{ID: itemID, FeedID: feedID}
 		if err := parseFeedItemRequest(r, &item); err != nil {
 			panic(err)
 		}
@@ -200,6 +334,42 @@ func routeFeeds(m *Mux) {
 		jsonify(item, w)
 	}))
 
+	m.Get("/api/v1/feeds/:feedID/items/:itemID/snapshot", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		itemID := services.RecordID(c.URLParams["itemID"])
+		snapshot, err := c.Services.Feeds.GetSnapshot(c.MustGetUser(), feedID, itemID)
+		if err != nil {
+			panic(err)
+		}
+		// the page is served from our origin, so it must not run anything
+		w.Header().Set("Content-Security-Policy", "sandbox; script-src 'none'")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(snapshot)
+	}))
+
+	// the item links of feeds that track clicks point here. Feed readers are
+	// not users, so it is not authenticated.
+	m.Get("/api/v1/feeds/:feedID/items/:itemID/click", func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		itemID := services.RecordID(c.URLParams["itemID"])
+		link, err := c.Services.Feeds.TrackClick(feedID, itemID, r.Referer(), r.UserAgent())
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, link, http.StatusFound)
+	})
+
+	m.Get("/api/v1/feeds/:feedID/items/:itemID/clicks", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		itemID := services.RecordID(c.URLParams["itemID"])
+		stats, err := c.Services.Feeds.GetItemClickStats(c.MustGetUser(), feedID, itemID)
+		if err != nil {
+			panic(err)
+		}
+		jsonify(stats, w)
+	}))
+
 	m.Delete("/api/v1/feeds/:feedID/items/:itemID", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
 		feedID := services.RecordID(c.URLParams["feedID"])
 		itemID := services.RecordID(c.URLParams["itemID"])
@@ -209,13 +379,447 @@ func routeFeeds(m *Mux) {
 		}
 		w.WriteHeader(http.StatusNoContent)
 	}))
+
+	m.Get("/api/v1/feeds/:feedID/email", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		address, err := c.Services.Feeds.GetEmailAddress(c.MustGetUser(), feedID)
+		if err != nil {
+			panic(err)
+		}
+		jsonify(map[string]string{"address": address}, w)
+	}))
+
+	// creates the secret address of the feed, or replaces it if it leaked
+	m.Post("/api/v1/feeds/:feedID/email", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		address, err := c.Services.Feeds.ResetEmailAddress(c.MustGetUser(), feedID)
+		if err != nil {
+			panic(err)
+		}
+		jsonify(map[string]string{"address": address}, w)
+	}))
+
+	m.Delete("/api/v1/feeds/:feedID/email", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		err := c.Services.Feeds.DeleteEmailAddress(c.MustGetUser(), feedID)
+		if err != nil {
+			panic(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	m.Get("/api/v1/feeds/:feedID/health", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		health, err := c.Services.Feeds.GetHealth(c.MustGetUser(), feedID)
+		if err != nil {
+			panic(err)
+		}
+		jsonify(health, w)
+	}))
+
+	m.Get("/api/v1/feeds/:feedID/subscribers", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		subscribers, err := c.Services.Feeds.GetSubscribers(c.MustGetUser(), feedID)
+		if err != nil {
+			panic(err)
+		}
+		jsonify(subscribers, w)
+	}))
+
+	m.Get("/api/v1/feeds/:feedID/clicks", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		stats, err := c.Services.Feeds.GetClickStats(c.MustGetUser(), feedID)
+		if err != nil {
+			panic(err)
+		}
+		jsonify(stats, w)
+	}))
+
+	m.Get("/api/v1/feeds/:feedID/sources", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		sources, err := c.Services.Feeds.GetSources(c.MustGetUser(), feedID)
+		if err != nil {
+			panic(err)
+		}
+		jsonify(sources, w)
+	}))
+
+	m.Post("/api/v1/feeds/:feedID/sources", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		source := services.FeedSource{FeedID: feedID}
+		if err := parseFeedSourceRequest(r, &source); err != nil {
+			panic(err)
+		}
+		err := c.Services.Feeds.AddSource(c.MustGetUser(), &source)
+		if err != nil {
+			panic(err)
+		}
+		jsonify(source, w)
+	}))
+
+	m.Delete("/api/v1/feeds/:feedID/sources/:sourceID", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		feedID := services.RecordID(c.URLParams["feedID"])
+		sourceID := services.RecordID(c.URLParams["sourceID"])
+		err := c.Services.Feeds.DeleteSource(c.MustGetUser(), feedID, sourceID)
+		if err != nil {
+			panic(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// routeHub sets up the WebSub hub advertised by the feed documents. Feed
+// readers are not users, so its requests are not authenticated.
+func routeHub(m *Mux) {
+	m.Post("/api/v1/hub", func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		req, err := parseWebSubRequest(r)
+		if err != nil {
+			panic(err)
+		}
+		if err := c.Services.Feeds.HandleWebSubRequest(req); err != nil {
+			panic(err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+func parseWebSubRequest(r *http.Request) (services.WebSubRequest, error) {
+	if err := r.ParseForm(); err != nil {
+		return services.WebSubRequest{}, NewHttpError(http.StatusBadRequest)
+	}
+	req := services.WebSubRequest{
+		Mode:     r.PostForm.Get("hub.mode"),
+		Topic:    r.PostForm.Get("hub.topic"),
+		Callback: r.PostForm.Get("hub.callback"),
+		Secret:   r.PostForm.Get("hub.secret"),
+	}
+	if req.Mode != "subscribe" && req.Mode != "unsubscribe" {
+		return req, NewHttpErrorWithText(http.StatusBadRequest, "Invalid hub.mode")
+	}
+	if u, err := url.Parse(req.Callback); err != nil || (u.Scheme != "http" && u.Scheme != "https") || !services.IsPublicHost(u.Host) {
+		return req, NewHttpErrorWithText(http.StatusBadRequest, "Invalid hub.callback")
+	}
+	if len(req.Secret) >= 200 {
+		return req, NewHttpErrorWithText(http.StatusBadRequest, "Invalid hub.secret")
+	}
+	if lease := r.PostForm.Get("hub.lease_seconds"); lease != "" {
+		var err error
+		if req.LeaseSeconds, err = strconv.Atoi(lease); err != nil {
+			return req, NewHttpErrorWithText(http.StatusBadRequest, "Invalid hub.lease_seconds")
+		}
+	}
+	return req, nil
+}
+
+func routeWebhooks(m *Mux) {
+	m.Get("/api/v1/webhooks", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		webhooks, err := c.Services.Feeds.GetWebhooks(c.MustGetUser())
+		if err != nil {
+			panic(err)
+		}
+		jsonify(webhooks, w)
+	}))
+
+	m.Post("/api/v1/webhooks", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		var webhook services.Webhook
+		if err := parseWebhookRequest(r, &webhook); err != nil {
+			panic(err)
+		}
+		if err := c.Services.Feeds.AddWebhook(c.MustGetUser(), &webhook); err != nil {
+			panic(err)
+		}
+		jsonify(webhook, w)
+	}))
+
+	m.Delete("/api/v1/webhooks/:webhookID", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		webhookID := services.RecordID(c.URLParams["webhookID"])
+		if err := c.Services.Feeds.DeleteWebhook(c.MustGetUser(), webhookID); err != nil {
+			panic(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	m.Get("/api/v1/webhooks/:webhookID/deliveries", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		webhookID := services.RecordID(c.URLParams["webhookID"])
+		deliveries, err := c.Services.Feeds.GetWebhookDeliveries(c.MustGetUser(), webhookID)
+		if err != nil {
+			panic(err)
+		}
+		jsonify(deliveries, w)
+	}))
+
+	m.Post("/api/v1/webhooks/:webhookID/deliveries/:deliveryID/redeliver", mustAuthenticateRW(func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		webhookID := services.RecordID(c.URLParams["webhookID"])
+		deliveryID := services.RecordID(c.URLParams["deliveryID"])
+		delivery, err := c.Services.Feeds.Redeliver(c.MustGetUser(), webhookID, deliveryID)
+		if err != nil {
+			panic(err)
+		}
+		jsonify(delivery, w)
+	}))
+}
+
+// routeShortLinks redirects the links of the builtin url shortener.
+func routeShortLinks(m *Mux) {
+	m.Get("/s/:code", func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		longURL, err := c.Services.Feeds.ResolveShortLink(c.URLParams["code"])
+		if err != nil {
+			panic(err)
+		}
+		http.Redirect(w, r, longURL, http.StatusFound)
+	})
+}
+
+var publicFeedContentTypes = map[services.FeedFormat]string{
+	services.FormatRSS:      "text/xml",
+	services.FormatAtom:     "application/atom+xml",
+	services.FormatJSONFeed: "application/feed+json",
+}
+
+// routePublicFeeds serves the documents of public feeds, which need no token.
+// The urls of renamed feeds redirect to their new slug.
+func routePublicFeeds(m *Mux) {
+	m.Get("/p/:username/:file", func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		slug, format, ok := services.ParsePublicFeedFile(c.URLParams["file"])
+		if !ok {
+			panic(services.ErrNotFound)
+		}
+		pub, err := c.Services.Feeds.ResolvePublicFeed(c.URLParams["username"], slug)
+		if err != nil {
+			panic(err)
+		}
+		if pub.Slug != slug {
+			file := c.URLParams["file"]
+			target := c.Services.Feeds.PublicURL(pub) + file[len(slug):]
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		doc, err := c.Services.Feeds.GetPublic(pub, format, feedOptionsFromRequest(r))
+		if err != nil {
+			panic(err)
+		}
+		writeFeedDocument(c, r, w, pub.FeedID, publicFeedContentTypes[format], doc)
+	})
+}
+
+const eventStreamKeepAlive = 30 * time.Second
+
+// routeEvents sets up the stream of the changes made by the user, as
+// server-sent events. EventSource cannot set headers, so clients authenticate
+// with the token form parameter, and resume with the Last-Event-ID header or
+// the lastEventID parameter.
+func routeEvents(m *Mux) {
+	m.Get("/api/v1/events", mustAuthenticate(services.AccessRead, func(c *MyFeedsContext, w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			panic(fmt.Errorf("streaming is not supported by %T", w))
+		}
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = r.URL.Query().Get("lastEventID")
+		}
+		var lastID int64
+		if lastEventID != "" {
+			var err error
+			if lastID, err = strconv.ParseInt(lastEventID, 10, 64); err != nil || lastID < 0 {
+				panic(NewHttpErrorWithText(http.StatusBadRequest, "Invalid Last-Event-ID"))
+			}
+		}
+
+		sub, err := c.Services.Feeds.SubscribeEvents(c.MustGetUser(), lastID)
+		if err != nil {
+			panic(err)
+		}
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if sub.Reset {
+			// some events are lost, the client has to fetch everything again
+			fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+		}
+		// the events published while the log was read are both replayed and
+		// received, the others are new even if their ids went backwards
+		var replayedID int64
+		for _, event := range sub.Replay {
+			writeStreamEvent(w, event)
+			replayedID = event.ID
+		}
+		flusher.Flush()
+
+		closed := w.(http.CloseNotifier).CloseNotify()
+		keepAlive := time.NewTicker(eventStreamKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case event, ok := <-sub.Events:
+				if !ok {
+					return
+				}
+				if event.ID <= replayedID {
+					continue
+				}
+				writeStreamEvent(w, event)
+				replayedID = 0
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case <-closed:
+				return
+			}
+			flusher.Flush()
+		}
+	}))
+}
+
+func writeStreamEvent(w io.Writer, event services.StreamEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Event, event.Data)
+}
+
+func feedOptionsFromRequest(r *http.Request) services.FeedOptions {
+	params := r.URL.Query()
+	opts := services.FeedOptions{Tag: params.Get("tag")}
+	if page := params.Get("page"); page != "" {
+		var err error
+		if opts.Page, err = strconv.Atoi(page); err != nil || opts.Page < 0 {
+			panic(NewHttpErrorWithText(http.StatusBadRequest, "Invalid page"))
+		}
+	}
+	return opts
+}
+
+type FeedImportResult struct {
+	Source    string            `json:"source,omitempty"`
+	Title     string            `json:"title"`
+	ID        services.RecordID `json:"id,omitempty"`
+	Link      string            `json:"link,omitempty"`
+	ItemCount int               `json:"itemCount"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// importRequestBody returns the document to import, sent either as the raw
+// request body or as the "file" field of a multipart form.
+func importRequestBody(r *http.Request) (io.ReadCloser, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, NewHttpErrorWithText(http.StatusBadRequest, "missing file field")
+		}
+		return file, nil
+	}
+	return r.Body, nil
+}
+
+func importFeed(c *MyFeedsContext, user services.User, imp services.ImportedFeed) FeedImportResult {
+	feed := imp.Feed
+	result := FeedImportResult{Source: imp.Source, Title: feed.Title}
+	if imp.Err != nil {
+		result.Error = imp.Err.Error()
+		return result
+	}
+
+	token, err := c.Services.Users.CreateToken(user, services.AccessRead)
+	if err == nil {
+		err = c.Services.Feeds.Create(user, token, &feed)
+	}
+
+	if err == services.ErrUniqueViolation {
+		result.Error = "a feed with this title already exists"
+	} else if err != nil {
+		log.Printf("failed to import feed %v: %v", feed.Title, err)
+		result.Error = "internal error"
+	} else {
+		result.ID = feed.ID
+		result.Link = feed.Link
+		result.ItemCount = len(feed.Items)
+	}
+	return result
+}
+
+type BookmarksImportSummary struct {
+	Feeds      []BookmarksImportFeed `json:"feeds"`
+	Duplicates []BookmarksImportItem `json:"duplicates"`
+	Rejected   []BookmarksImportItem `json:"rejected"`
+}
+
+type BookmarksImportFeed struct {
+	ID        services.RecordID `json:"id"`
+	Title     string            `json:"title"`
+	Link      string            `json:"link"`
+	Created   bool              `json:"created"`
+	ItemCount int               `json:"itemCount"`
+}
+
+type BookmarksImportItem struct {
+	Feed   string `json:"feed"`
+	Link   string `json:"link"`
+	Title  string `json:"title"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// importBookmarks adds the items of an imported folder to the feed of the same
+// title, creating it if needed.
+func importBookmarks(c *MyFeedsContext, user services.User, folder services.Feed, summary *BookmarksImportSummary) {
+	reject := func(reason string) {
+		for _, item := range folder.Items {
+			summary.Rejected = append(summary.Rejected, BookmarksImportItem{folder.Title, item.Link, item.Title, reason})
+		}
+	}
+
+	created := false
+	feed, err := c.Services.Feeds.FindByTitle(user, folder.Title)
+	if err == services.ErrNotFound {
+		feed = services.Feed{Title: folder.Title}
+		var token string
+		token, err = c.Services.Users.CreateToken(user, services.AccessRead)
+		if err == nil {
+			err = c.Services.Feeds.Create(user, token, &feed)
+		}
+		created = err == nil
+	}
+	if err == services.ErrUniqueViolation {
+		reject("a feed with this title already exists")
+		return
+	} else if err != nil {
+		log.Printf("failed to import bookmarks into %v: %v", folder.Title, err)
+		reject("internal error")
+		return
+	}
+
+	added, duplicates, err := c.Services.Feeds.ImportItems(user, feed.ID, folder.Items)
+	if err != nil {
+		log.Printf("failed to import bookmarks into %v: %v", feed.ID, err)
+		reject("internal error")
+		return
+	}
+	for _, item := range duplicates {
+		summary.Duplicates = append(summary.Duplicates, BookmarksImportItem{Feed: feed.Title, Link: item.Link, Title: item.Title})
+	}
+	summary.Feeds = append(summary.Feeds, BookmarksImportFeed{feed.ID, feed.Title, feed.Link, created, len(added)})
 }
 
 type FeedRequest struct {
-	ID          string
-	Title       string `validate:"nonzero,min=1"`
-	Description string
-	Items       []FeedItemRequest
+	ID            string
+	Title         string `validate:"nonzero,min=1"`
+	Description   string
+	Items         []FeedItemRequest
+	ImageURL      string
+	Author        string
+	Category      string
+	Explicit      bool
+	Query         *services.SmartQuery
+	MaxItems      int `validate:"min=0"`
+	NewestFirst   bool
+	NoFullText    bool
+	HideDeadLinks bool
+	Snapshots     bool
+	TrackClicks   bool
+	Public        bool
+	Slug          string
 }
 
 func parseFeedRequest(r *http.Request, feed *services.Feed) error {
@@ -226,6 +830,19 @@ func parseFeedRequest(r *http.Request, feed *services.Feed) error {
 	feed.ID = services.RecordID(feedReq.ID)
 	feed.Title = feedReq.Title
 	feed.Description = feedReq.Description
+	feed.ImageURL = feedReq.ImageURL
+	feed.Author = feedReq.Author
+	feed.Category = feedReq.Category
+	feed.Explicit = feedReq.Explicit
+	feed.Query = feedReq.Query
+	feed.MaxItems = feedReq.MaxItems
+	feed.NewestFirst = feedReq.NewestFirst
+	feed.NoFullText = feedReq.NoFullText
+	feed.HideDeadLinks = feedReq.HideDeadLinks
+	feed.Snapshots = feedReq.Snapshots
+	feed.TrackClicks = feedReq.TrackClicks
+	feed.Public = feedReq.Public
+	feed.Slug = feedReq.Slug
 	if feedReq.Items != nil {
 		feed.Items = make([]services.FeedItem, 0, len(feedReq.Items))
 		for _, itemReq := range feedReq.Items {
@@ -238,10 +855,14 @@ func parseFeedRequest(r *http.Request, feed *services.Feed) error {
 }
 
 type FeedItemRequest struct {
-	ID          string
-	Link        string `validate:"nonzero,min=1"`
-	Title       string `validate:"nonzero,min=1"`
-	Description string
+	ID              string
+	Link            string `validate:"nonzero,min=1"`
+	Title           string // fetched from the page if missing
+	Description     string
+	EnclosureURL    string
+	EnclosureType   string
+	EnclosureLength int64 `validate:"min=0"`
+	Tags            []string
 }
 
 func parseFeedItemRequest(r *http.Request, item *services.FeedItem) error {
@@ -258,6 +879,64 @@ func copyFeedItemFromRequest(itemReq FeedItemRequest, item *services.FeedItem) {
 	item.Link = itemReq.Link
 	item.Title = itemReq.Title
 	item.Description = itemReq.Description
+	item.EnclosureURL = itemReq.EnclosureURL
+	item.EnclosureType = itemReq.EnclosureType
+	item.EnclosureLength = itemReq.EnclosureLength
+	item.Tags = itemReq.Tags
+}
+
+type FeedSourceRequest struct {
+	URL     string `validate:"nonzero,min=1"`
+	Include []string
+	Exclude []string
+}
+
+func parseFeedSourceRequest(r *http.Request, source *services.FeedSource) error {
+	var sourceReq FeedSourceRequest
+	if err := parseAndValidate(r, &sourceReq); err != nil {
+		return err
+	}
+	if u, err := url.Parse(sourceReq.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return NewHttpErrorWithText(http.StatusBadRequest, "Invalid source url")
+	}
+	source.URL = sourceReq.URL
+	source.Include = sourceReq.Include
+	source.Exclude = sourceReq.Exclude
+	return nil
+}
+
+type WebhookRequest struct {
+	URL    string `validate:"nonzero,min=1"`
+	FeedID services.RecordID
+	Events []string
+}
+
+func parseWebhookRequest(r *http.Request, webhook *services.Webhook) error {
+	var webhookReq WebhookRequest
+	if err := parseAndValidate(r, &webhookReq); err != nil {
+		return err
+	}
+	if u, err := url.Parse(webhookReq.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || !services.IsPublicHost(u.Host) {
+		return NewHttpErrorWithText(http.StatusBadRequest, "Invalid webhook url")
+	}
+	for _, event := range webhookReq.Events {
+		if !isWebhookEvent(event) {
+			return NewHttpErrorWithText(http.StatusBadRequest, "Invalid event "+event)
+		}
+	}
+	webhook.URL = webhookReq.URL
+	webhook.FeedID = webhookReq.FeedID
+	webhook.Events = webhookReq.Events
+	return nil
+}
+
+func isWebhookEvent(event string) bool {
+	for _, e := range services.WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
 }
 
 func parseAndValidate(r *http.Request, result interface{}) error {
@@ -286,16 +965,37 @@ func jsonify(result interface{}, w http.ResponseWriter) {
 	writeAs(w, "application/json", bytes)
 }
 
-func writeCacheable(r *http.Request, w http.ResponseWriter, contentType string, cacheable services.FeedData) {
+// writeCacheable writes the data, or a 304 if the client has it already, in
+// which case it returns true.
+func writeCacheable(r *http.Request, w http.ResponseWriter, contentType string, cacheable services.FeedData) bool {
 	w.Header().Set("ETag", cacheable.ETag)
 	w.Header().Set("Cache-Control", "public")
 
 	reqEtag := r.Header.Get("If-None-Match")
 	if cacheable.ETag == reqEtag {
 		w.WriteHeader(304)
-	} else {
-		writeAs(w, contentType, cacheable.Bytes)
+		return true
+	}
+	writeAs(w, contentType, cacheable.Bytes)
+	return false
+}
+
+// writeFeedDocument writes a feed document, and counts the fetch to estimate
+// the subscribers of the feed.
+func writeFeedDocument(c *MyFeedsContext, r *http.Request, w http.ResponseWriter, feedID services.RecordID, contentType string, doc services.FeedData) {
+	notModified := writeCacheable(r, w, contentType, doc)
+	c.Services.Feeds.RecordFetch(feedID, fetchToken(r), r.UserAgent(), notModified)
+}
+
+// fetchToken is the token a feed document was fetched with, which tells its
+// subscribers apart. Other credentials identify the user rather than one of
+// their readers, and are never recorded.
+func fetchToken(r *http.Request) string {
+	method, creds, err := parseAuthorizationFromRequest(r)
+	if err != nil || method != AuthMethodToken || len(creds) == 0 {
+		return ""
 	}
+	return creds[0]
 }
 
 func writeAs(w http.ResponseWriter, contentType string, bytes []byte) {
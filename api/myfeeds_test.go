@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFetchToken(t *testing.T) {
+	tests := []struct {
+		url           string
+		authorization string
+		token         string
+	}{
+		{"/feeds/1/rss?_tok=secret", "", "secret"},
+		{"/feeds/1/rss", `Token token="secret"`, "secret"},
+		{"/feeds/1/rss", "Basic YWxpY2VAZXhhbXBsZS5jb206cGFzc3dvcmQ=", ""},
+		{"/feeds/1/rss", "", ""},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		if token := fetchToken(r); token != test.token {
+			t.Errorf("%v %v: expected token %q, got %q", test.url, test.authorization, test.token, token)
+		}
+	}
+}
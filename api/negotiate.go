@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/vincentcr/myfeeds/api/services"
+)
+
+type feedRepresentation struct {
+	contentType string
+	format      services.FeedFormat
+}
+
+// feedRepresentations lists the media types a single feed can be served as, in
+// order of preference. The first one is used when the client doesn't care.
+var feedRepresentations = []feedRepresentation{
+	{"application/json", services.FormatJSON},
+	{"application/rss+xml", services.FormatRSS},
+	{"application/atom+xml", services.FormatAtom},
+	{"application/feed+json", services.FormatJSONFeed},
+	{"text/xml", services.FormatRSS},
+	{"application/xml", services.FormatRSS},
+}
+
+type mediaRange struct {
+	typ     string
+	subtype string
+	q       float64
+}
+
+// negotiateFeedRepresentation picks the best feed representation for the
+// given Accept header. It returns false if none of them is acceptable.
+func negotiateFeedRepresentation(accept string) (feedRepresentation, bool) {
+	ranges := parseAccept(accept)
+	if len(ranges) == 0 {
+		return feedRepresentations[0], true
+	}
+
+	best := -1
+	bestQ := 0.0
+	for idx, rep := range feedRepresentations {
+		if q := acceptQuality(ranges, rep.contentType); q > bestQ {
+			best = idx
+			bestQ = q
+		}
+	}
+
+	if best < 0 {
+		return feedRepresentation{}, false
+	}
+	return feedRepresentations[best], true
+}
+
+// acceptQuality returns the quality of the most specific range matching the
+// media type, or 0 if no range matches.
+func acceptQuality(ranges []mediaRange, mediaType string) float64 {
+	typ, subtype := splitMediaType(mediaType)
+	q := 0.0
+	specificity := -1
+	for _, r := range ranges {
+		var s int
+		switch {
+		case r.typ == typ && r.subtype == subtype:
+			s = 2
+		case r.typ == typ && r.subtype == "*":
+			s = 1
+		case r.typ == "*" && r.subtype == "*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			specificity = s
+			q = r.q
+		}
+	}
+	return q
+}
+
+func parseAccept(accept string) []mediaRange {
+	ranges := []mediaRange{}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		typ, subtype := splitMediaType(params[0])
+		if typ == "" {
+			continue
+		}
+
+		r := mediaRange{typ: typ, subtype: subtype, q: 1}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					r.q = q
+				}
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+func splitMediaType(mediaType string) (string, string) {
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(mediaType)), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vincentcr/myfeeds/api/services"
+)
+
+func TestNegotiateFeedRepresentation(t *testing.T) {
+	cases := []struct {
+		accept      string
+		format      services.FeedFormat
+		contentType string
+	}{
+		{"", services.FormatJSON, "application/json"},
+		{"*/*", services.FormatJSON, "application/json"},
+		{"application/json", services.FormatJSON, "application/json"},
+		{"application/rss+xml", services.FormatRSS, "application/rss+xml"},
+		{"text/xml", services.FormatRSS, "text/xml"},
+		{"application/atom+xml", services.FormatAtom, "application/atom+xml"},
+		{"application/feed+json", services.FormatJSONFeed, "application/feed+json"},
+		{"application/rss+xml;q=0.5, application/atom+xml", services.FormatAtom, "application/atom+xml"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", services.FormatRSS, "application/xml"},
+		{"application/*;q=0.2, application/atom+xml;q=0.9", services.FormatAtom, "application/atom+xml"},
+		{"application/json;q=0, */*", services.FormatRSS, "application/rss+xml"},
+	}
+
+	for _, tc := range cases {
+		rep, ok := negotiateFeedRepresentation(tc.accept)
+		if !ok {
+			t.Errorf("%q: expected a representation", tc.accept)
+			continue
+		}
+		if rep.format != tc.format || rep.contentType != tc.contentType {
+			t.Errorf("%q: expected %v (%v), got %v (%v)", tc.accept, tc.format, tc.contentType, rep.format, rep.contentType)
+		}
+	}
+}
+
+func TestNegotiateFeedRepresentationNotAcceptable(t *testing.T) {
+	for _, accept := range []string{"text/html", "image/*", "application/json;q=0"} {
+		if rep, ok := negotiateFeedRepresentation(accept); ok {
+			t.Errorf("%q: expected no representation, got %v", accept, rep)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore keeps opaque documents, such as page snapshots, under keys made
+// of slash-separated names.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	// Get returns ErrNotFound if there is nothing under key
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// fileBlobStore stores each blob as a file under a directory of the local
+// filesystem.
+type fileBlobStore struct {
+	dir string
+}
+
+func newFileBlobStore(dir string) (*fileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create blob directory %v: %v", dir, err)
+	}
+	return &fileBlobStore{dir}, nil
+}
+
+func (store *fileBlobStore) path(key string) (string, error) {
+	for _, name := range strings.Split(key, "/") {
+		if name == "" || name == "." || name == ".." {
+			return "", fmt.Errorf("invalid blob key %q", key)
+		}
+	}
+	return filepath.Join(store.dir, filepath.FromSlash(key)), nil
+}
+
+func (store *fileBlobStore) Put(key string, data []byte) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// written to a temporary file first, so that readers never see a partial blob
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to write blob %v: %v", key, err)
+	}
+	return nil
+}
+
+func (store *fileBlobStore) Get(key string) ([]byte, error) {
+	path, err := store.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (store *fileBlobStore) Delete(key string) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
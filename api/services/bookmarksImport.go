@@ -0,0 +1,233 @@
+package services
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// feeds of bookmarks that are in no folder or tag
+const (
+	defaultBookmarksFeed   = "Bookmarks"
+	defaultPocketFeed      = "Pocket"
+	defaultInstapaperFeed  = "Instapaper"
+	bookmarksMaxFolderSize = 10000
+)
+
+// RejectedBookmark is a bookmark that can't be imported as an item.
+type RejectedBookmark struct {
+	Folder string
+	Link   string
+	Title  string
+	Reason string
+}
+
+// headings of exports that are the bookmarks root or a read status rather
+// than folders
+var bookmarksNonFolders = map[string]bool{"bookmarks": true, "bookmarks menu": true, "unread": true, "archive": true, "read archive": true}
+
+type bookmark struct {
+	folder string
+	item   FeedItem
+}
+
+// ParseBookmarks reads a browser bookmarks export (the Netscape html format),
+// or a Pocket or Instapaper export, either html or csv. It returns a feed per
+// folder. Bookmarks in no folder go to the feed of their first tag if they
+// have one, and to a feed named after the service otherwise. Items keep their
+// tags and original dates.
+func ParseBookmarks(r io.Reader) ([]ImportedFeed, []RejectedBookmark, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, importMaxDocumentSize))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read bookmarks: %v", err)
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	var bookmarks []bookmark
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		bookmarks = parseBookmarksHTML(string(data))
+	} else if bookmarks, err = parseBookmarksCSV(data); err != nil {
+		return nil, nil, err
+	}
+	if len(bookmarks) == 0 {
+		return nil, nil, fmt.Errorf("no bookmarks found")
+	}
+
+	imported := []ImportedFeed{}
+	folders := map[string]int{}
+	rejected := []RejectedBookmark{}
+	for _, b := range bookmarks {
+		if link := resolveLink(nil, b.item.Link); link == "" {
+			rejected = append(rejected, RejectedBookmark{b.folder, b.item.Link, b.item.Title, "not a web link"})
+			continue
+		}
+
+		key := strings.ToLower(b.folder)
+		idx, exists := folders[key]
+		if !exists {
+			idx = len(imported)
+			folders[key] = idx
+			imported = append(imported, ImportedFeed{Feed: Feed{Title: b.folder, Items: []FeedItem{}}})
+		}
+		if len(imported[idx].Feed.Items) >= bookmarksMaxFolderSize {
+			rejected = append(rejected, RejectedBookmark{b.folder, b.item.Link, b.item.Title, "too many bookmarks in folder"})
+			continue
+		}
+		imported[idx].Feed.Items = append(imported[idx].Feed.Items, b.item)
+	}
+	return imported, rejected, nil
+}
+
+func newBookmark(folder, defaultFolder, link, title string, added time.Time, tags []string) bookmark {
+	tags = normalizeTags(tags)
+	folder = strings.TrimSpace(folder)
+	if bookmarksNonFolders[strings.ToLower(folder)] {
+		folder = ""
+	}
+	if folder == "" && len(tags) > 0 {
+		folder = tags[0]
+	}
+	if folder == "" {
+		folder = defaultFolder
+	}
+	link = strings.TrimSpace(link)
+	return bookmark{folder, FeedItem{Link: link, Title: strings.TrimSpace(title), Tags: tags, dateAdded: added}}
+}
+
+// parseBookmarksHTML handles the Netscape format, where folders are <h3>
+// headings followed by nested <dl> lists, as well as the Pocket and
+// Instapaper exports, flat lists under <h1> headings.
+func parseBookmarksHTML(src string) []bookmark {
+	bookmarks := []bookmark{}
+	defaultFolder := defaultBookmarksFeed
+	if indexFold(src, "<title>pocket") >= 0 {
+		defaultFolder = defaultPocketFeed
+	} else if indexFold(src, "<title>instapaper") >= 0 {
+		defaultFolder = defaultInstapaperFeed
+	}
+
+	var folders []string // folder of each open <dl>
+	var section, pendingFolder string
+	var heading, anchor *bytes.Buffer
+	var attrs map[string]string
+
+	tokenizeHTML(src, func(tok htmlToken) bool {
+		switch tok.kind {
+		case htmlText:
+			if heading != nil {
+				heading.WriteString(tok.text)
+			} else if anchor != nil {
+				anchor.WriteString(tok.text)
+			}
+		case htmlStartTag:
+			switch tok.name {
+			case "h1", "h2", "h3":
+				heading = &bytes.Buffer{}
+			case "dl":
+				folders = append(folders, pendingFolder)
+				pendingFolder = ""
+			case "a":
+				anchor = &bytes.Buffer{}
+				attrs = tok.attrs
+			}
+		case htmlEndTag:
+			switch tok.name {
+			case "h1", "h2":
+				if heading != nil {
+					section = collapseSpaces(heading.String())
+				}
+				heading = nil
+			case "h3":
+				if heading != nil {
+					pendingFolder = collapseSpaces(heading.String())
+				}
+				heading = nil
+			case "dl":
+				if len(folders) > 0 {
+					folders = folders[:len(folders)-1]
+				}
+			case "a":
+				if anchor == nil {
+					break
+				}
+				folder := section
+				for idx := len(folders) - 1; idx >= 0; idx-- {
+					if folders[idx] != "" {
+						folder = folders[idx]
+						break
+					}
+				}
+				added := parseUnixTime(firstNonEmpty(attrs["add_date"], attrs["time_added"]))
+				tags := strings.FieldsFunc(attrs["tags"], func(r rune) bool { return r == ',' || r == '|' })
+				title := collapseSpaces(anchor.String())
+				bookmarks = append(bookmarks, newBookmark(folder, defaultFolder, attrs["href"], title, added, tags))
+				anchor = nil
+			}
+		}
+		return true
+	})
+	return bookmarks
+}
+
+// parseBookmarksCSV handles the Pocket (title, url, time_added, tags, status)
+// and Instapaper (URL, Title, Selection, Folder, Timestamp) csv exports, by
+// the names of their columns.
+func parseBookmarksCSV(data []byte) ([]bookmark, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv document: %v", err)
+	}
+	if len(records) < 1 {
+		return nil, fmt.Errorf("empty csv document")
+	}
+
+	columns := map[string]int{}
+	for idx, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = idx
+	}
+	if _, ok := columns["url"]; !ok {
+		return nil, fmt.Errorf("csv document has no url column")
+	}
+	field := func(record []string, names ...string) string {
+		for _, name := range names {
+			if idx, ok := columns[name]; ok && idx < len(record) {
+				return record[idx]
+			}
+		}
+		return ""
+	}
+
+	defaultFolder := defaultPocketFeed
+	if _, ok := columns["folder"]; ok {
+		defaultFolder = defaultInstapaperFeed
+	}
+
+	bookmarks := []bookmark{}
+	for _, record := range records[1:] {
+		folder := field(record, "folder")
+		tags := strings.FieldsFunc(strings.Trim(field(record, "tags"), "[]"), func(r rune) bool {
+			return r == '|' || r == ','
+		})
+		for idx := range tags {
+			tags[idx] = strings.Trim(tags[idx], `" `)
+		}
+		added := parseUnixTime(field(record, "time_added", "timestamp"))
+		bookmarks = append(bookmarks, newBookmark(folder, defaultFolder, field(record, "url"), field(record, "title"), added, tags))
+	}
+	return bookmarks, nil
+}
+
+func parseUnixTime(value string) time.Time {
+	secs, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || secs <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0).UTC()
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testNetscapeBookmarks = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+    <DT><H3 ADD_DATE="1440000000">Go</H3>
+    <DL><p>
+        <DT><A HREF="https://golang.org/" ADD_DATE="1440000100" TAGS="lang,Google">The Go Programming Language</A>
+        <DT><H3>Talks</H3>
+        <DL><p>
+            <DT><A HREF="https://talks.golang.org/">Go talks</A>
+        </DL><p>
+        <DT><A HREF="https://blog.golang.org/">Go blog</A>
+    </DL><p>
+    <DT><A HREF="https://www.postgresql.org/">PostgreSQL</A>
+    <DT><A HREF="javascript:alert(1)">bookmarklet</A>
+</DL><p>`
+
+func TestParseBookmarksNetscape(t *testing.T) {
+	imported, rejected, err := ParseBookmarks(strings.NewReader(testNetscapeBookmarks))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"Go":        {"https://golang.org/", "https://blog.golang.org/"},
+		"Talks":     {"https://talks.golang.org/"},
+		"Bookmarks": {"https://www.postgresql.org/"},
+	}
+	if len(imported) != len(expected) {
+		t.Fatalf("expected %v feeds, got %#v", len(expected), imported)
+	}
+	for _, imp := range imported {
+		links := []string{}
+		for _, item := range imp.Feed.Items {
+			links = append(links, item.Link)
+		}
+		if !reflect.DeepEqual(links, expected[imp.Feed.Title]) {
+			t.Errorf("feed %v: expected links %v, got %v", imp.Feed.Title, expected[imp.Feed.Title], links)
+		}
+	}
+
+	item := imported[0].Feed.Items[0]
+	if item.Title != "The Go Programming Language" || !item.dateAdded.Equal(time.Unix(1440000100, 0)) ||
+		!reflect.DeepEqual(item.Tags, []string{"lang", "google"}) {
+		t.Errorf("unexpected item %#v", item)
+	}
+
+	if len(rejected) != 1 || rejected[0].Link != "javascript:alert(1)" {
+		t.Errorf("unexpected rejected bookmarks %#v", rejected)
+	}
+}
+
+func TestParseBookmarksPocket(t *testing.T) {
+	doc := `<!DOCTYPE html><html><head><title>Pocket Export</title></head><body>
+<h1>Unread</h1><ul>
+<li><a href="https://example.com/1" time_added="1440000000" tags="go,db">One</a></li>
+<li><a href="https://example.com/2" time_added="1440000001" tags="">Two</a></li>
+</ul>
+<h1>Read Archive</h1><ul>
+<li><a href="https://example.com/3" time_added="1440000002" tags="db">Three</a></li>
+</ul></body></html>`
+
+	imported, _, err := ParseBookmarks(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := []string{}
+	for _, imp := range imported {
+		titles = append(titles, imp.Feed.Title+":"+strconv.Itoa(len(imp.Feed.Items)))
+	}
+	if expected := []string{"go:1", "Pocket:1", "db:1"}; !reflect.DeepEqual(titles, expected) {
+		t.Errorf("expected feeds %v, got %v", expected, titles)
+	}
+}
+
+func TestParseBookmarksInstapaperCSV(t *testing.T) {
+	doc := "URL,Title,Selection,Folder,Timestamp\n" +
+		"https://example.com/1,\"One, first\",,Unread,1440000000\n" +
+		"https://example.com/2,Two,some text,Reading,1440000001\n" +
+		"https://example.com/3,Three,,Archive,\n"
+
+	imported, _, err := ParseBookmarks(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 2 || imported[0].Feed.Title != "Instapaper" || imported[1].Feed.Title != "Reading" {
+		t.Fatalf("unexpected feeds %#v", imported)
+	}
+	items := imported[0].Feed.Items
+	if len(items) != 2 || items[0].Title != "One, first" || !items[0].dateAdded.Equal(time.Unix(1440000000, 0)) || !items[1].dateAdded.IsZero() {
+		t.Errorf("unexpected items %#v", items)
+	}
+}
@@ -0,0 +1,213 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	clickReferrerMaxLength = 2048
+	clickStatsDays         = 30
+
+	clicksByDay     = "to_char(date_clicked, 'YYYY-MM-DD')"
+	clicksByRefer   = "coalesce(link_host(referrer), '')"
+	clicksByAgent   = "user_agent"
+	mostClicksFirst = "count(*) DESC, key LIMIT 10"
+)
+
+// user agent families, matched in order against the user agent of clicks.
+// Feed readers and bots come first since they often mention a browser too.
+var userAgentFamilies = []struct {
+	family string
+	marker string
+}{
+	{"Feedly", "feedly"},
+	{"Inoreader", "inoreader"},
+	{"NewsBlur", "newsblur"},
+	{"The Old Reader", "theoldreader"},
+	{"NetNewsWire", "netnewswire"},
+	{"Reeder", "reeder"},
+	{"Bot", "bot"},
+	{"Bot", "crawler"},
+	{"Bot", "spider"},
+	{"curl", "curl/"},
+	{"Edge", "edg/"},
+	{"Edge", "edge/"},
+	{"Opera", "opr/"},
+	{"Firefox", "firefox/"},
+	{"Chrome", "chrome/"},
+	{"Chrome", "crios/"},
+	{"Safari", "safari/"},
+}
+
+// FeedClickStats sums up the clicks on the items of a feed.
+type FeedClickStats struct {
+	FeedID     RecordID         `json:"feedID"`
+	Clicks     int              `json:"clicks"`
+	Items      []ItemClickStats `json:"items"`
+	Referrers  []ClickCount     `json:"referrers"`
+	UserAgents []ClickCount     `json:"userAgents"`
+}
+
+// ItemClickStats sums up the clicks on an item. Days, referrers and user
+// agents are only detailed in the stats of a single item.
+type ItemClickStats struct {
+	ItemID     RecordID     `json:"itemID"`
+	Title      string       `json:"title"`
+	Link       string       `json:"link"`
+	Clicks     int          `json:"clicks"`
+	LastClick  *time.Time   `json:"lastClick"`
+	Days       []ClickCount `json:"days,omitempty"`
+	Referrers  []ClickCount `json:"referrers,omitempty"`
+	UserAgents []ClickCount `json:"userAgents,omitempty"`
+}
+
+// ClickCount is the number of clicks of a day, referrer or user agent family.
+type ClickCount struct {
+	Key    string `json:"key"`
+	Clicks int    `json:"clicks"`
+}
+
+// userAgentFamily reduces a user agent to the browser or feed reader it
+// belongs to.
+func userAgentFamily(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown"
+	}
+	lower := strings.ToLower(userAgent)
+	for _, f := range userAgentFamilies {
+		if strings.Contains(lower, f.marker) {
+			return f.family
+		}
+	}
+	return "Other"
+}
+
+// TrackClick records a click on the link of an item of a feed that tracks
+// clicks, and returns the link. Items of smart feeds belong to other feeds of
+// the same owner.
+func (fs *Feeds) TrackClick(feedID RecordID, itemID RecordID, referrer string, userAgent string) (string, error) {
+	var link string
+	var ownerID RecordID
+	err := fs.db.QueryRow(`SELECT feed_items.link, feeds.owner_id
+		FROM feeds INNER JOIN feed_items ON feed_items.owner_id = feeds.owner_id
+		WHERE feeds.id=$1 AND feed_items.id=$2 AND feeds.track_clicks
+			AND (feed_items.feed_id = feeds.id OR feeds.query IS NOT NULL)`,
+		feedID, itemID).Scan(&link, &ownerID)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	if len(referrer) > clickReferrerMaxLength {
+		referrer = referrer[:clickReferrerMaxLength]
+	}
+	// the reader gets to the link even if the click cannot be counted
+	_, err = fs.db.Exec(`INSERT INTO item_clicks(feed_id, item_id, owner_id, referrer, user_agent)
+		VALUES($1, $2, $3, NULLIF($4, ''), $5)`,
+		feedID, itemID, ownerID, referrer, userAgentFamily(userAgent))
+	if err != nil {
+		log.Printf("unable to record click on item %v of feed %v: %v", itemID, feedID, err)
+	}
+	return link, nil
+}
+
+// GetClickStats returns the clicks on the items of a feed, most clicked first.
+func (fs *Feeds) GetClickStats(user User, feedID RecordID) (FeedClickStats, error) {
+	if err := fs.checkFeedOwner(user, feedID); err != nil {
+		return FeedClickStats{}, err
+	}
+	stats := FeedClickStats{FeedID: feedID, Items: []ItemClickStats{}}
+
+	rows, err := fs.db.Query(`SELECT item_id, feed_items.title, feed_items.link, count(*), max(date_clicked)
+		FROM item_clicks INNER JOIN feed_items ON feed_items.id = item_clicks.item_id
+		WHERE item_clicks.feed_id=$1 AND item_clicks.owner_id=$2
+		GROUP BY item_id, feed_items.title, feed_items.link ORDER BY count(*) DESC, max(date_clicked) DESC`,
+		feedID, user.ID)
+	if err != nil {
+		return FeedClickStats{}, fmt.Errorf("unable to query clicks of feed %v: %v", feedID, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item ItemClickStats
+		var lastClick time.Time
+		if err := rows.Scan(&item.ItemID, &item.Title, &item.Link, &item.Clicks, &lastClick); err != nil {
+			return FeedClickStats{}, err
+		}
+		item.LastClick = &lastClick
+		stats.Clicks += item.Clicks
+		stats.Items = append(stats.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return FeedClickStats{}, err
+	}
+
+	filter := "feed_id=$1 AND owner_id=$2"
+	if stats.Referrers, err = fs.countClicks(clicksByRefer, mostClicksFirst, filter, feedID, user.ID); err != nil {
+		return FeedClickStats{}, err
+	}
+	if stats.UserAgents, err = fs.countClicks(clicksByAgent, mostClicksFirst, filter, feedID, user.ID); err != nil {
+		return FeedClickStats{}, err
+	}
+	return stats, nil
+}
+
+// GetItemClickStats returns the clicks on an item of a feed, with the number
+// of clicks of each of the last days.
+func (fs *Feeds) GetItemClickStats(user User, feedID RecordID, itemID RecordID) (ItemClickStats, error) {
+	stats := ItemClickStats{ItemID: itemID}
+	var lastClick pq.NullTime
+	err := fs.db.QueryRow(`SELECT feed_items.title, feed_items.link,
+			(SELECT count(*) FROM item_clicks WHERE feed_id=$1 AND item_id=$2),
+			(SELECT max(date_clicked) FROM item_clicks WHERE feed_id=$1 AND item_id=$2)
+		FROM feed_items WHERE id=$2 AND owner_id=$3`,
+		feedID, itemID, user.ID).Scan(&stats.Title, &stats.Link, &stats.Clicks, &lastClick)
+	if err == sql.ErrNoRows {
+		return ItemClickStats{}, ErrNotFound
+	} else if err != nil {
+		return ItemClickStats{}, err
+	}
+	if lastClick.Valid {
+		stats.LastClick = &lastClick.Time
+	}
+
+	filter := "feed_id=$1 AND owner_id=$2 AND item_id=$3"
+	recent := filter + fmt.Sprintf(" AND date_clicked > NOW() - interval '%d days'", clickStatsDays)
+	if stats.Days, err = fs.countClicks(clicksByDay, "key", recent, feedID, user.ID, itemID); err != nil {
+		return ItemClickStats{}, err
+	}
+	if stats.Referrers, err = fs.countClicks(clicksByRefer, mostClicksFirst, filter, feedID, user.ID, itemID); err != nil {
+		return ItemClickStats{}, err
+	}
+	if stats.UserAgents, err = fs.countClicks(clicksByAgent, mostClicksFirst, filter, feedID, user.ID, itemID); err != nil {
+		return ItemClickStats{}, err
+	}
+	return stats, nil
+}
+
+// countClicks groups the clicks matching filter by key, keeping the first
+// ones in order.
+func (fs *Feeds) countClicks(key string, order string, filter string, args ...interface{}) ([]ClickCount, error) {
+	rows, err := fs.db.Query(fmt.Sprintf("SELECT %s AS key, count(*) FROM item_clicks WHERE %s GROUP BY key ORDER BY %s",
+		key, filter, order), args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to count clicks by %v: %v", key, err)
+	}
+	defer rows.Close()
+
+	counts := []ClickCount{}
+	for rows.Next() {
+		var count ClickCount
+		if err := rows.Scan(&count.Key, &count.Clicks); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,22 @@
+package services
+
+import "testing"
+
+func TestUserAgentFamily(t *testing.T) {
+	tests := map[string]string{
+		"": "Unknown",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36":           "Chrome",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0": "Edge",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_1) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15":        "Safari",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0":                                                    "Firefox",
+		"Feedly/1.0 (+http://www.feedly.com/fetcher.html; like FeedFetcher-Google)":                                                 "Feedly",
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                                                  "Bot",
+		"curl/8.4.0": "curl",
+		"Lynx/2.8.9": "Other",
+	}
+	for userAgent, expected := range tests {
+		if actual := userAgentFamily(userAgent); actual != expected {
+			t.Errorf("expected family of %q to be %v, got %v", userAgent, expected, actual)
+		}
+	}
+}
@@ -2,14 +2,21 @@ package services
 
 import (
 	"log"
+	"net/url"
 	"os"
+	"strings"
 )
 
 type Config struct {
-	PublicURL   string
-	BitlyAPIKey string
-	Postgres    PGConfig
-	RedisAddr   string
+	PublicURL          string
+	Shortener          string // builtin (the default), bitly or none
+	ShortURLBase       string // where builtin short links are served, defaults to the host of PublicURL
+	BitlyAPIKey        string
+	Postgres           PGConfig
+	RedisAddr          string
+	SMTPAddr           string
+	InboundEmailDomain string
+	SnapshotsDir       string // where page snapshots are stored, if enabled
 }
 type PGConfig struct {
 	Addr     string
@@ -26,9 +33,14 @@ func loadConfig() (Config, error) {
 
 func loadConfigFromEnv() (Config, error) {
 	return Config{
-		PublicURL:   os.Getenv("API_PUBLIC_URL"),
-		BitlyAPIKey: os.Getenv("BITLY_API_KEY"),
-		RedisAddr:   "redis:6379",
+		PublicURL:          os.Getenv("API_PUBLIC_URL"),
+		Shortener:          os.Getenv("URL_SHORTENER"),
+		ShortURLBase:       os.Getenv("SHORT_URL_BASE"),
+		BitlyAPIKey:        os.Getenv("BITLY_API_KEY"),
+		RedisAddr:          "redis:6379",
+		SMTPAddr:           os.Getenv("SMTP_ADDR"),
+		InboundEmailDomain: os.Getenv("INBOUND_EMAIL_DOMAIN"),
+		SnapshotsDir:       os.Getenv("SNAPSHOTS_DIR"),
 		Postgres: PGConfig{
 			Addr:     "postgres:5432",
 			Database: os.Getenv("POSTGRES_ENV_DB_NAME"),
@@ -37,3 +49,24 @@ func loadConfigFromEnv() (Config, error) {
 		},
 	}, nil
 }
+
+func (config Config) inboundEmailEnabled() bool {
+	return config.SMTPAddr != "" && config.InboundEmailDomain != ""
+}
+
+func (config Config) shortURLBase() string {
+	if config.ShortURLBase != "" {
+		return strings.TrimSuffix(config.ShortURLBase, "/")
+	}
+	return config.rootURL()
+}
+
+// rootURL is the scheme and host of PublicURL, where the routes outside of
+// the api are served.
+func (config Config) rootURL() string {
+	u, err := url.Parse(config.PublicURL)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+const (
+	eventLogSize             = 500
+	eventLogExpiration       = 24 * time.Hour
+	eventListenerBufferSize  = 64
+	eventSubscriberRetryWait = 5 * time.Second
+)
+
+// StreamEvent is a change pushed to the event streams of a user. Data is the
+// json event, as posted to webhooks.
+type StreamEvent struct {
+	ID    int64
+	Event string
+	Data  string
+}
+
+// EventSubscription receives the changes made by a user. Replay holds the
+// events missed since the last event a client received, and Reset is true if
+// some of them are no longer in the log. Events may also contain some of the
+// replayed events, and is closed if the subscription falls behind.
+type EventSubscription struct {
+	Replay []StreamEvent
+	Reset  bool
+	Events <-chan StreamEvent
+
+	user   User
+	events chan StreamEvent
+	stream *eventStream
+}
+
+// changeEvent is an event queued for webhooks, to be pushed to the event
+// streams once the change is committed.
+type changeEvent struct {
+	user    User
+	event   string
+	payload []byte
+}
+
+// eventStream dispatches the events published to redis by any instance to
+// the subscriptions of this one.
+type eventStream struct {
+	mutex     sync.Mutex
+	listeners map[RecordID]map[chan StreamEvent]bool
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{listeners: map[RecordID]map[chan StreamEvent]bool{}}
+}
+
+func eventLogKey(userID RecordID) string {
+	return fmt.Sprintf("events.log.%v", userID)
+}
+
+func eventSeqKey(userID RecordID) string {
+	return fmt.Sprintf("events.seq.%v", userID)
+}
+
+func eventChannel(userID RecordID) string {
+	return fmt.Sprintf("events.%v", userID)
+}
+
+// log entries and messages are formatted as id, event and data separated by
+// newlines, which the json data does not contain.
+func formatStreamEvent(event StreamEvent) string {
+	return fmt.Sprintf("%d\n%s\n%s", event.ID, event.Event, event.Data)
+}
+
+func parseStreamEvent(entry string) (StreamEvent, error) {
+	parts := strings.SplitN(entry, "\n", 3)
+	if len(parts) != 3 {
+		return StreamEvent{}, fmt.Errorf("invalid stream event %q", entry)
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return StreamEvent{}, fmt.Errorf("invalid stream event %q: %v", entry, err)
+	}
+	return StreamEvent{ID: id, Event: parts[1], Data: parts[2]}, nil
+}
+
+// publishEvent appends an event to the log of its user and pushes it to the
+// subscribers of every instance. The change is already committed, so errors
+// are only logged. Only the log expires: the sequence is kept so that the ids
+// of the events of a user keep increasing.
+func (fs *Feeds) publishEvent(ev changeEvent) {
+	script := `
+		local id = redis.call('incr', KEYS[1]);
+		local entry = id .. '\n' .. ARGV[1];
+		redis.call('zadd', KEYS[2], id, entry);
+		redis.call('zremrangebyrank', KEYS[2], 0, -tonumber(ARGV[2]) - 1);
+		redis.call('expire', KEYS[2], ARGV[3]);
+		redis.call('publish', ARGV[4], entry);
+		return id;
+	`
+	keys := []string{eventSeqKey(ev.user.ID), eventLogKey(ev.user.ID)}
+	args := []string{
+		ev.event + "\n" + string(ev.payload),
+		strconv.Itoa(eventLogSize),
+		strconv.Itoa(int(eventLogExpiration.Seconds())),
+		eventChannel(ev.user.ID),
+	}
+	if err := fs.redis.Eval(script, keys, args).Err(); err != nil {
+		log.Printf("unable to publish %v event of %v: %v", ev.event, ev.user, err)
+	}
+}
+
+// SubscribeEvents starts receiving the changes of a user. If lastEventID is
+// set, the events that followed it are replayed from the log.
+func (fs *Feeds) SubscribeEvents(user User, lastEventID int64) (*EventSubscription, error) {
+	events := make(chan StreamEvent, eventListenerBufferSize)
+	sub := &EventSubscription{Events: events, user: user, events: events, stream: fs.events}
+	// listen before reading the log, so that no event falls in between
+	fs.events.add(user.ID, events)
+	if lastEventID <= 0 {
+		return sub, nil
+	}
+
+	entries, err := fs.redis.ZRangeByScore(eventLogKey(user.ID), redis.ZRangeByScore{
+		Min: "(" + strconv.FormatInt(lastEventID, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		sub.Close()
+		return nil, fmt.Errorf("unable to read event log of %v: %v", user, err)
+	}
+	for _, entry := range entries {
+		event, err := parseStreamEvent(entry)
+		if err != nil {
+			sub.Close()
+			return nil, err
+		}
+		sub.Replay = append(sub.Replay, event)
+	}
+
+	if len(sub.Replay) > 0 {
+		sub.Reset = sub.Replay[0].ID != lastEventID+1
+	} else {
+		seq, err := fs.redis.Get(eventSeqKey(user.ID)).Int64()
+		if err != nil && err != redis.Nil {
+			sub.Close()
+			return nil, fmt.Errorf("unable to read event sequence of %v: %v", user, err)
+		}
+		sub.Reset = seq != lastEventID
+	}
+	return sub, nil
+}
+
+// Close stops the subscription.
+func (sub *EventSubscription) Close() {
+	sub.stream.remove(sub.user.ID, sub.events)
+}
+
+func (stream *eventStream) add(userID RecordID, listener chan StreamEvent) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.listeners[userID] == nil {
+		stream.listeners[userID] = map[chan StreamEvent]bool{}
+	}
+	stream.listeners[userID][listener] = true
+}
+
+func (stream *eventStream) remove(userID RecordID, listener chan StreamEvent) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.removeLocked(userID, listener)
+}
+
+func (stream *eventStream) removeLocked(userID RecordID, listener chan StreamEvent) {
+	if !stream.listeners[userID][listener] {
+		return
+	}
+	delete(stream.listeners[userID], listener)
+	if len(stream.listeners[userID]) == 0 {
+		delete(stream.listeners, userID)
+	}
+	close(listener)
+}
+
+// dispatch sends an event to the listeners of a user. A listener that is too
+// far behind is closed, so that its client reconnects and replays the log.
+func (stream *eventStream) dispatch(userID RecordID, event StreamEvent) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	for listener := range stream.listeners[userID] {
+		select {
+		case listener <- event:
+		default:
+			stream.removeLocked(userID, listener)
+		}
+	}
+}
+
+// closeAll closes all the listeners, whose clients may have missed events.
+func (stream *eventStream) closeAll() {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	for userID, listeners := range stream.listeners {
+		for listener := range listeners {
+			stream.removeLocked(userID, listener)
+		}
+	}
+}
+
+// startEventsSubscriber receives the events published by all the instances.
+func (fs *Feeds) startEventsSubscriber() {
+	go func() {
+		for {
+			if err := fs.receiveEvents(); err != nil {
+				log.Printf("event stream subscription failed: %v", err)
+			}
+			fs.events.closeAll()
+			time.Sleep(eventSubscriberRetryWait)
+		}
+	}()
+}
+
+func (fs *Feeds) receiveEvents() error {
+	pubsub := fs.redis.PubSub()
+	defer pubsub.Close()
+	if err := pubsub.PSubscribe(eventChannel("*")); err != nil {
+		return err
+	}
+	for {
+		msg, err := pubsub.Receive()
+		if err != nil {
+			return err
+		}
+		if msg, ok := msg.(*redis.PMessage); ok {
+			event, err := parseStreamEvent(msg.Payload)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			fs.events.dispatch(RecordID(strings.TrimPrefix(msg.Channel, eventChannel(""))), event)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package services
+
+import "testing"
+
+func TestParseStreamEvent(t *testing.T) {
+	event := StreamEvent{ID: 42, Event: EventItemAdded, Data: `{"event":"item.added","data":{"title":"a\nb"}}`}
+	actual, err := parseStreamEvent(formatStreamEvent(event))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != event {
+		t.Errorf("expected %#v, got %#v", event, actual)
+	}
+	for _, entry := range []string{"", "42\nitem.added", "x\nitem.added\n{}"} {
+		if _, err := parseStreamEvent(entry); err == nil {
+			t.Errorf("expected %q to be invalid", entry)
+		}
+	}
+}
+
+func TestEventStreamDispatch(t *testing.T) {
+	stream := newEventStream()
+	listener := make(chan StreamEvent, 1)
+	other := make(chan StreamEvent, 1)
+	stream.add("user", listener)
+	stream.add("other", other)
+
+	stream.dispatch("user", StreamEvent{ID: 1})
+	if event := <-listener; event.ID != 1 {
+		t.Errorf("expected event 1, got %v", event)
+	}
+	if len(other) != 0 {
+		t.Error("expected events of other users not to be dispatched")
+	}
+
+	// a listener that falls behind is closed
+	stream.dispatch("user", StreamEvent{ID: 2})
+	stream.dispatch("user", StreamEvent{ID: 3})
+	if event := <-listener; event.ID != 2 {
+		t.Errorf("expected event 2, got %v", event)
+	}
+	if _, ok := <-listener; ok {
+		t.Error("expected listener to be closed")
+	}
+	stream.remove("user", listener)
+
+	stream.closeAll()
+	if _, ok := <-other; ok {
+		t.Error("expected all listeners to be closed")
+	}
+}
@@ -0,0 +1,309 @@
+package services
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const importFetchConcurrency = 8
+const importMaxDocumentSize = 10 << 20
+
+var importClient = &http.Client{Timeout: 30 * time.Second, Transport: guardedTransport}
+
+// ImportedFeed is a feed parsed out of an imported document, ready to be
+// created. Source is the upstream URL it was fetched from, if any, and Err is
+// set when the feed could not be fetched or parsed.
+type ImportedFeed struct {
+	Source string
+	Feed   Feed
+	Err    error
+}
+
+type opmlDocument struct {
+	Body struct {
+		Outlines []opmlOutline `xml:"outline"`
+	} `xml:"body"`
+}
+
+type opmlOutline struct {
+	Text        string        `xml:"text,attr"`
+	Title       string        `xml:"title,attr"`
+	Description string        `xml:"description,attr"`
+	XMLURL      string        `xml:"xmlUrl,attr"`
+	HTMLURL     string        `xml:"htmlUrl,attr"`
+	URL         string        `xml:"url,attr"`
+	Outlines    []opmlOutline `xml:"outline"`
+}
+
+func (o opmlOutline) title() string {
+	if o.Title != "" {
+		return o.Title
+	}
+	return o.Text
+}
+
+func (o opmlOutline) link() string {
+	if o.URL != "" {
+		return o.URL
+	}
+	return o.HTMLURL
+}
+
+type rssDocument struct {
+	Channel struct {
+		Title       string `xml:"title"`
+		Description string `xml:"description"`
+		Items       []struct {
+			GUID        string `xml:"guid"`
+			Title       string `xml:"title"`
+			Link        string `xml:"link"`
+			Description string `xml:"description"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+type atomDocument struct {
+	Title    string `xml:"title"`
+	Subtitle string `xml:"subtitle"`
+	Entries  []struct {
+		ID      string     `xml:"id"`
+		Title   string     `xml:"title"`
+		Links   []atomLink `xml:"link"`
+		Summary string     `xml:"summary"`
+	} `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+func atomAlternateLink(links []atomLink) string {
+	for _, link := range links {
+		if link.Rel == "" || link.Rel == "alternate" {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+// ParseImport reads an OPML, RSS or Atom document and returns the feeds it
+// describes. Feeds listed in an OPML document by xmlUrl are fetched and
+// parsed in turn; folders of plain links become feeds of their own.
+func ParseImport(r io.Reader) ([]ImportedFeed, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, importMaxDocumentSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read import document: %v", err)
+	}
+
+	root, err := xmlRootName(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if root == "opml" {
+		return parseOpmlImport(data)
+	}
+
+	feed, err := parseFeedDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	return []ImportedFeed{{Feed: feed}}, nil
+}
+
+func parseOpmlImport(data []byte) ([]ImportedFeed, error) {
+	var doc opmlDocument
+	if err := unmarshalXML(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid opml document: %v", err)
+	}
+
+	imported := []ImportedFeed{}
+	collectOpmlFeeds(doc.Body.Outlines, &imported)
+	fetchImportedFeeds(imported)
+	return imported, nil
+}
+
+func collectOpmlFeeds(outlines []opmlOutline, imported *[]ImportedFeed) {
+	for _, outline := range outlines {
+		if outline.XMLURL != "" {
+			*imported = append(*imported, ImportedFeed{Source: outline.XMLURL, Feed: Feed{Title: outline.title()}})
+			continue
+		}
+
+		items := []FeedItem{}
+		for _, child := range outline.Outlines {
+			if child.XMLURL == "" && len(child.Outlines) == 0 && child.link() != "" {
+				items = append(items, newImportedItem(child.link(), child.title(), child.Description))
+			}
+		}
+		if len(items) > 0 {
+			*imported = append(*imported, ImportedFeed{Feed: Feed{Title: outline.title(), Description: outline.Description, Items: items}})
+		}
+
+		collectOpmlFeeds(outline.Outlines, imported)
+	}
+}
+
+func fetchImportedFeeds(imported []ImportedFeed) {
+	sem := make(chan struct{}, importFetchConcurrency)
+	done := make(chan struct{})
+	pending := 0
+	for idx := range imported {
+		if imported[idx].Source == "" {
+			continue
+		}
+		pending++
+		go func(imp *ImportedFeed) {
+			sem <- struct{}{}
+			defer func() {
+				<-sem
+				done <- struct{}{}
+			}()
+			feed, err := fetchFeedDocument(imp.Source)
+			if err != nil {
+				imp.Err = err
+				return
+			}
+			if imp.Feed.Title != "" {
+				feed.Title = imp.Feed.Title
+			}
+			imp.Feed = feed
+		}(&imported[idx])
+	}
+
+	for ; pending > 0; pending-- {
+		<-done
+	}
+}
+
+func fetchFeedDocument(url string) (Feed, error) {
+	resp, err := importClient.Get(url)
+	if err != nil {
+		return Feed{}, fmt.Errorf("unable to fetch %v: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Feed{}, fmt.Errorf("fetching %v returned %v status", url, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, importMaxDocumentSize))
+	if err != nil {
+		return Feed{}, fmt.Errorf("unable to read %v: %v", url, err)
+	}
+	return parseFeedDocument(data)
+}
+
+// parseFeedDocument parses a single RSS 2.0 or Atom 1.0 document.
+func parseFeedDocument(data []byte) (Feed, error) {
+	root, err := xmlRootName(data)
+	if err != nil {
+		return Feed{}, err
+	}
+
+	feed := Feed{Items: []FeedItem{}}
+	switch root {
+	case "rss":
+		var doc rssDocument
+		if err := unmarshalXML(data, &doc); err != nil {
+			return Feed{}, fmt.Errorf("invalid rss document: %v", err)
+		}
+		feed.Title = doc.Channel.Title
+		feed.Description = doc.Channel.Description
+		for _, item := range doc.Channel.Items {
+			if link := strings.TrimSpace(item.Link); link != "" {
+				imported := newImportedItem(link, item.Title, item.Description)
+				imported.guid = strings.TrimSpace(item.GUID)
+				feed.Items = append(feed.Items, imported)
+			}
+		}
+	case "feed":
+		var doc atomDocument
+		if err := unmarshalXML(data, &doc); err != nil {
+			return Feed{}, fmt.Errorf("invalid atom document: %v", err)
+		}
+		feed.Title = doc.Title
+		feed.Description = doc.Subtitle
+		for _, entry := range doc.Entries {
+			if link := strings.TrimSpace(atomAlternateLink(entry.Links)); link != "" {
+				imported := newImportedItem(link, entry.Title, entry.Summary)
+				imported.guid = strings.TrimSpace(entry.ID)
+				feed.Items = append(feed.Items, imported)
+			}
+		}
+	default:
+		return Feed{}, fmt.Errorf("unsupported document type <%s>", root)
+	}
+
+	feed.Title = strings.TrimSpace(feed.Title)
+	if feed.Title == "" {
+		return Feed{}, fmt.Errorf("document has no title")
+	}
+
+	// guids must be unique within a feed; repeated ones are dropped
+	guids := map[string]bool{}
+	for idx, item := range feed.Items {
+		if guids[item.guid] {
+			feed.Items[idx].guid = ""
+		}
+		guids[item.guid] = item.guid != ""
+	}
+	return feed, nil
+}
+
+func newImportedItem(link, title, description string) FeedItem {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		title = link
+	}
+	return FeedItem{Link: link, Title: title, Description: strings.TrimSpace(description)}
+}
+
+func xmlRootName(data []byte) (string, error) {
+	decoder := newXMLDecoder(data)
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return "", fmt.Errorf("invalid xml document: %v", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
+
+func unmarshalXML(data []byte, v interface{}) error {
+	return newXMLDecoder(data).Decode(v)
+}
+
+func newXMLDecoder(data []byte) *xml.Decoder {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	decoder.CharsetReader = latin1CharsetReader
+	return decoder
+}
+
+// latin1CharsetReader handles the single-byte charsets commonly found in
+// older feeds; encoding/xml only understands utf-8 by itself.
+func latin1CharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "latin-1", "us-ascii", "ascii", "windows-1252":
+	default:
+		return nil, fmt.Errorf("unsupported charset %v", charset)
+	}
+
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	runes := make([]rune, len(data))
+	for idx, b := range data {
+		runes[idx] = rune(b)
+	}
+	return strings.NewReader(string(runes)), nil
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testRss = `<?xml version="1.0" encoding="ISO-8859-1"?>
+<rss version="2.0"><channel>
+  <title>Golang links</title>
+  <description>stuff about go</description>
+  <item><title>Go blog</title><link>https://blog.golang.org/</link><description>the blog</description></item>
+  <item><link>https://golang.org/doc/</link></item>
+  <item><title>no link</title></item>
+</channel></rss>`
+
+const testAtom = `<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Postgres links</title>
+  <entry>
+    <title>Docs</title>
+    <link rel="self" href="https://example.com/self"/>
+    <link href="https://www.postgresql.org/docs/"/>
+    <summary>the manual</summary>
+  </entry>
+</feed>`
+
+func TestParseImportRss(t *testing.T) {
+	imported, err := ParseImport(strings.NewReader(testRss))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 1 {
+		t.Fatalf("expected 1 feed, got %v", len(imported))
+	}
+
+	feed := imported[0].Feed
+	if feed.Title != "Golang links" || feed.Description != "stuff about go" {
+		t.Errorf("unexpected feed %#v", feed)
+	}
+	if len(feed.Items) != 2 {
+		t.Fatalf("expected 2 items, got %#v", feed.Items)
+	}
+	if feed.Items[1].Title != "https://golang.org/doc/" {
+		t.Errorf("expected title to default to link, got %v", feed.Items[1].Title)
+	}
+}
+
+func TestParseImportAtom(t *testing.T) {
+	imported, err := ParseImport(strings.NewReader(testAtom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := imported[0].Feed
+	if feed.Title != "Postgres links" || len(feed.Items) != 1 {
+		t.Fatalf("unexpected feed %#v", feed)
+	}
+	if item := feed.Items[0]; item.Link != "https://www.postgresql.org/docs/" || item.Description != "the manual" {
+		t.Errorf("unexpected item %#v", item)
+	}
+}
+
+func TestParseImportOpml(t *testing.T) {
+	defer allowLocalServers()()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rss":
+			fmt.Fprint(w, testRss)
+		case "/atom":
+			fmt.Fprint(w, testAtom)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	opml := `<opml version="2.0"><body>
+	  <outline text="folder">
+	    <outline text="Renamed" type="rss" xmlUrl="` + server.URL + `/rss"/>
+	    <outline text="Missing" type="rss" xmlUrl="` + server.URL + `/missing"/>
+	  </outline>
+	  <outline text="Atom" type="rss" xmlUrl="` + server.URL + `/atom"/>
+	  <outline text="Bookmarks">
+	    <outline text="Example" url="https://example.com/"/>
+	  </outline>
+	</body></opml>`
+
+	imported, err := ParseImport(strings.NewReader(opml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 4 {
+		t.Fatalf("expected 4 feeds, got %#v", imported)
+	}
+
+	if imp := imported[0]; imp.Err != nil || imp.Feed.Title != "Renamed" || len(imp.Feed.Items) != 2 {
+		t.Errorf("unexpected import %#v", imp)
+	}
+	if imp := imported[1]; imp.Err == nil {
+		t.Errorf("expected error for missing feed, got %#v", imp)
+	}
+	if imp := imported[2]; imp.Err != nil || imp.Feed.Title != "Atom" || len(imp.Feed.Items) != 1 {
+		t.Errorf("unexpected import %#v", imp)
+	}
+	if imp := imported[3]; imp.Feed.Title != "Bookmarks" || len(imp.Feed.Items) != 1 || imp.Feed.Items[0].Link != "https://example.com/" {
+		t.Errorf("unexpected import %#v", imp)
+	}
+}
+
+func TestParseImportOpmlRefusesLocalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testRss)
+	}))
+	defer server.Close()
+
+	opml := `<opml version="2.0"><body><outline text="Local" type="rss" xmlUrl="` + server.URL + `/rss"/></body></opml>`
+	imported, err := ParseImport(strings.NewReader(opml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 1 || imported[0].Err == nil {
+		t.Errorf("expected feed on a local address to be refused, got %#v", imported)
+	}
+}
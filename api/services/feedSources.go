@@ -0,0 +1,374 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	sourcesPollCheckInterval = time.Minute
+	sourcesPollBatchSize     = 50
+	sourcePollInterval       = 30 * time.Minute
+	sourceMaxBackoff         = 24 * time.Hour
+)
+
+// FeedSource is an upstream RSS or Atom feed whose new entries are copied
+// into a feed. When Include is set, only the entries containing one of its
+// keywords are copied; entries containing one of the Exclude keywords never
+// are.
+type FeedSource struct {
+	ID         RecordID   `json:"id"`
+	FeedID     RecordID   `json:"feedID"`
+	URL        string     `json:"url"`
+	Include    []string   `json:"include"`
+	Exclude    []string   `json:"exclude"`
+	LastPolled *time.Time `json:"lastPolled"`
+	LastError  string     `json:"lastError,omitempty"`
+	ownerID    RecordID
+}
+
+// polledSource is a source along with its polling state
+type polledSource struct {
+	FeedSource
+	etag         string
+	lastModified string
+	errorCount   int
+}
+
+func (fs *Feeds) AddSource(user User, source *FeedSource) error {
+	var isSmart bool
+	err := fs.db.QueryRow("SELECT query IS NOT NULL FROM feeds WHERE id=$1 AND owner_id=$2", source.FeedID, user.ID).Scan(&isSmart)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	} else if isSmart {
+		return ErrSmartFeedItems
+	}
+
+	source.ID = newID()
+	source.ownerID = user.ID
+	source.Include = normalizeKeywords(source.Include)
+	source.Exclude = normalizeKeywords(source.Exclude)
+	include, _ := json.Marshal(source.Include)
+	exclude, _ := json.Marshal(source.Exclude)
+
+	_, err = fs.db.Exec(`INSERT INTO feed_sources(id, feed_id, owner_id, url, include_keywords, exclude_keywords)
+		VALUES($1, $2, $3, $4, $5::jsonb, $6::jsonb)`,
+		source.ID, source.FeedID, source.ownerID, source.URL, string(include), string(exclude))
+	if err != nil {
+		if isUniqueError(err) {
+			return ErrUniqueViolation
+		}
+		return fmt.Errorf("unable to create source %#v: %v", source, err)
+	}
+	return nil
+}
+
+func (fs *Feeds) GetSources(user User, feedID RecordID) ([]FeedSource, error) {
+	rows, err := fs.db.Query(`SELECT id, feed_id, url, include_keywords::text, exclude_keywords::text, last_polled, coalesce(last_error, '')
+		FROM feed_sources WHERE feed_id=$1 AND owner_id=$2 ORDER BY date_created`, feedID, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query sources of feed %v: %v", feedID, err)
+	}
+	defer rows.Close()
+
+	sources := []FeedSource{}
+	for rows.Next() {
+		var source FeedSource
+		var include, exclude string
+		var lastPolled pq.NullTime
+		if err := rows.Scan(&source.ID, &source.FeedID, &source.URL, &include, &exclude, &lastPolled, &source.LastError); err != nil {
+			return nil, err
+		}
+		if err := unmarshalKeywords(include, exclude, &source); err != nil {
+			return nil, err
+		}
+		if lastPolled.Valid {
+			source.LastPolled = &lastPolled.Time
+		}
+		sources = append(sources, source)
+	}
+	return sources, rows.Err()
+}
+
+func (fs *Feeds) DeleteSource(user User, feedID RecordID, sourceID RecordID) error {
+	res, err := fs.db.Exec("DELETE FROM feed_sources WHERE id=$1 AND feed_id=$2 AND owner_id=$3", sourceID, feedID, user.ID)
+	if err != nil {
+		return err
+	}
+	return checkRowsAffected(res, 1)
+}
+
+func normalizeKeywords(keywords []string) []string {
+	normalized := []string{}
+	for _, keyword := range keywords {
+		if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" {
+			normalized = append(normalized, keyword)
+		}
+	}
+	return normalized
+}
+
+func unmarshalKeywords(include, exclude string, source *FeedSource) error {
+	if err := json.Unmarshal([]byte(include), &source.Include); err != nil {
+		return fmt.Errorf("invalid include keywords of source %v: %v", source.ID, err)
+	}
+	if err := json.Unmarshal([]byte(exclude), &source.Exclude); err != nil {
+		return fmt.Errorf("invalid exclude keywords of source %v: %v", source.ID, err)
+	}
+	return nil
+}
+
+func (fs *Feeds) startSourcesPollLoop(interval time.Duration) {
+	go func() {
+		tick := time.Tick(interval)
+		for range tick {
+			if err := fs.pollDueSources(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+func (fs *Feeds) pollDueSources() error {
+	// the due sources are claimed by pushing back their next poll
+	rows, err := fs.db.Query(`UPDATE feed_sources SET next_poll = timeofday()::TIMESTAMP + $1 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM feed_sources WHERE next_poll <= NOW() ORDER BY next_poll LIMIT $2 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, feed_id, owner_id, url, include_keywords::text, exclude_keywords::text,
+			coalesce(etag, ''), coalesce(last_modified, ''), error_count`,
+		sourcePollInterval.Seconds(), sourcesPollBatchSize)
+	if err != nil {
+		return fmt.Errorf("unable to query due sources: %v", err)
+	}
+
+	sources := []polledSource{}
+	for rows.Next() {
+		var source polledSource
+		var include, exclude string
+		err := rows.Scan(&source.ID, &source.FeedID, &source.ownerID, &source.URL, &include, &exclude,
+			&source.etag, &source.lastModified, &source.errorCount)
+		if err == nil {
+			err = unmarshalKeywords(include, exclude, &source.FeedSource)
+		}
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		sources = append(sources, source)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	processClaimedRows(len(sources), func(idx int) {
+		fs.pollSource(sources[idx])
+	})
+	return nil
+}
+
+func (fs *Feeds) pollSource(source polledSource) {
+	etag, lastModified, err := fs.fetchSource(source)
+	if err != nil {
+		log.Printf("unable to poll source %v of feed %v: %v", source.URL, source.FeedID, err)
+		source.errorCount++
+		_, err = fs.db.Exec(`UPDATE feed_sources SET last_polled=NOW(), last_error=$1, error_count=$2,
+				next_poll = NOW() + $3 * interval '1 second'
+			WHERE id=$4`,
+			err.Error(), source.errorCount, sourceBackoff(source.errorCount).Seconds(), source.ID)
+	} else {
+		_, err = fs.db.Exec(`UPDATE feed_sources SET last_polled=NOW(), last_error=NULL, error_count=0,
+				etag=NULLIF($1, ''), last_modified=NULLIF($2, ''), next_poll = NOW() + $3 * interval '1 second'
+			WHERE id=$4`,
+			etag, lastModified, sourcePollInterval.Seconds(), source.ID)
+	}
+	if err != nil {
+		log.Printf("unable to save poll state of source %v: %v", source.ID, err)
+	}
+}
+
+// sourceBackoff is how long to wait before polling again a source that
+// failed errorCount times in a row.
+func sourceBackoff(errorCount int) time.Duration {
+	backoff := sourcePollInterval
+	for idx := 1; idx < errorCount && backoff < sourceMaxBackoff; idx++ {
+		backoff *= 2
+	}
+	if backoff > sourceMaxBackoff {
+		backoff = sourceMaxBackoff
+	}
+	return backoff
+}
+
+// fetchSource copies the new entries of the source into its feed. It returns
+// the validators to send with the next conditional request.
+func (fs *Feeds) fetchSource(source polledSource) (string, string, error) {
+	req, err := http.NewRequest("GET", source.URL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	if source.etag != "" {
+		req.Header.Set("If-None-Match", source.etag)
+	}
+	if source.lastModified != "" {
+		req.Header.Set("If-Modified-Since", source.lastModified)
+	}
+
+	resp, err := importClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return source.etag, source.lastModified, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("upstream returned %v status", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, importMaxDocumentSize))
+	if err != nil {
+		return "", "", err
+	}
+	upstream, err := parseFeedDocument(data)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := fs.addSourceItems(source, upstream.Items); err != nil {
+		return "", "", err
+	}
+	return resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+}
+
+func (fs *Feeds) addSourceItems(source polledSource, upstreamItems []FeedItem) error {
+	known, err := sourceGUIDs(fs.db, source)
+	if err != nil {
+		return err
+	}
+	items := newSourceItems(source, known, upstreamItems)
+	if len(items) == 0 {
+		return nil
+	}
+
+	user := User{ID: source.ownerID}
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := recordSourceGUIDs(tx, source, items); err != nil {
+		return err
+	}
+	items, _, err = fs.addItems(user, source.FeedID, items, tx)
+	if err != nil {
+		return fmt.Errorf("unable to add items to feed %v: %v", source.FeedID, err)
+	}
+	evs, err := fs.emitItemsAdded(tx, user, source.FeedID, items)
+	if err != nil {
+		return err
+	}
+	fs.invalidateFeedCache(feedCacheHint{user, source.FeedID})
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, ev := range evs {
+		fs.publishEvent(ev)
+	}
+	fs.enrichItemsLater(user, items)
+	return nil
+}
+
+// sourceGUID scopes the guid of an upstream item to its source, since the
+// sources of a feed may use the same guids.
+func sourceGUID(source polledSource, guid string) string {
+	return string(source.ID) + ":" + guid
+}
+
+// newSourceItems returns the upstream items of a source that weren't seen
+// before and pass its keyword filters, with their guid scoped to the source.
+func newSourceItems(source polledSource, known map[string]bool, upstreamItems []FeedItem) []FeedItem {
+	items := []FeedItem{}
+	for _, item := range upstreamItems {
+		if item.guid == "" {
+			item.guid = item.Link
+		}
+		item.guid = sourceGUID(source, item.guid)
+		if known[item.guid] || !matchesKeywords(item, source.Include, source.Exclude) {
+			continue
+		}
+		known[item.guid] = true
+		items = append(items, item)
+	}
+	return items
+}
+
+// sourceGUIDs returns the guids of the entries seen in a source. They are
+// kept apart from the items they were copied into, so that deleted items are
+// not copied again; the guids of the items copied before that are found in
+// the items themselves.
+func sourceGUIDs(db queryer, source polledSource) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT guid FROM feed_source_guids WHERE source_id=$1
+		UNION SELECT guid FROM feed_items WHERE feed_id=$2 AND guid LIKE $3 || '%'`,
+		source.ID, source.FeedID, sourceGUID(source, ""))
+	if err != nil {
+		return nil, fmt.Errorf("unable to query guids of source %v: %v", source.URL, err)
+	}
+	defer rows.Close()
+
+	guids := map[string]bool{}
+	for rows.Next() {
+		var guid string
+		if err := rows.Scan(&guid); err != nil {
+			return nil, err
+		}
+		guids[guid] = true
+	}
+	return guids, rows.Err()
+}
+
+// recordSourceGUIDs marks the entries of a source as seen.
+func recordSourceGUIDs(db execer, source polledSource, items []FeedItem) error {
+	for _, item := range items {
+		_, err := db.Exec(`INSERT INTO feed_source_guids(source_id, guid) VALUES($1, $2)
+			ON CONFLICT (source_id, guid) DO NOTHING`, source.ID, item.guid)
+		if err != nil {
+			return fmt.Errorf("unable to record guid of source %v: %v", source.URL, err)
+		}
+	}
+	return nil
+}
+
+// matchesKeywords tells whether the item passes the include and exclude
+// keyword filters, which apply to its title and description.
+func matchesKeywords(item FeedItem, include, exclude []string) bool {
+	text := strings.ToLower(item.Title + " " + item.Description)
+	for _, keyword := range exclude {
+		if strings.Contains(text, keyword) {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, keyword := range include {
+		if strings.Contains(text, keyword) {
+			return true
+		}
+	}
+	return false
+}
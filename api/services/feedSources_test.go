@@ -0,0 +1,113 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchesKeywords(t *testing.T) {
+	item := FeedItem{Title: "Go 1.5 is released", Description: "With a new garbage collector"}
+	tests := []struct {
+		include, exclude []string
+		expected         bool
+	}{
+		{nil, nil, true},
+		{[]string{"garbage"}, nil, true},
+		{[]string{"rust", "go 1.5"}, nil, true},
+		{[]string{"rust"}, nil, false},
+		{nil, []string{"collector"}, false},
+		{[]string{"go"}, []string{"released"}, false},
+	}
+	for _, test := range tests {
+		if actual := matchesKeywords(item, test.include, test.exclude); actual != test.expected {
+			t.Errorf("include %v, exclude %v: expected %v, got %v", test.include, test.exclude, test.expected, actual)
+		}
+	}
+}
+
+func TestSourceBackoff(t *testing.T) {
+	expected := []time.Duration{30 * time.Minute, 30 * time.Minute, time.Hour, 2 * time.Hour}
+	for errorCount, backoff := range expected {
+		if actual := sourceBackoff(errorCount); actual != backoff {
+			t.Errorf("%v errors: expected %v, got %v", errorCount, backoff, actual)
+		}
+	}
+	if actual := sourceBackoff(100); actual != sourceMaxBackoff {
+		t.Errorf("expected backoff to be capped to %v, got %v", sourceMaxBackoff, actual)
+	}
+}
+
+func TestParseFeedDocumentGUIDs(t *testing.T) {
+	feed, err := parseFeedDocument([]byte(`<rss><channel><title>t</title>
+		<item><guid>a</guid><link>http://example.com/1</link></item>
+		<item><guid>a</guid><link>http://example.com/2</link></item>
+		<item><link>http://example.com/3</link></item>
+	</channel></rss>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	guids := []string{}
+	for _, item := range feed.Items {
+		guids = append(guids, item.guid)
+	}
+	if len(guids) != 3 || guids[0] != "a" || guids[1] != "" || guids[2] != "" {
+		t.Errorf("unexpected guids %q", guids)
+	}
+}
+
+func TestSourceGUID(t *testing.T) {
+	first := polledSource{FeedSource: FeedSource{ID: "a"}}
+	second := polledSource{FeedSource: FeedSource{ID: "b"}}
+	if sourceGUID(first, "1") == sourceGUID(second, "1") {
+		t.Error("expected guids of different sources not to collide")
+	}
+}
+
+func TestNewSourceItems(t *testing.T) {
+	source := polledSource{FeedSource: FeedSource{ID: "a", Exclude: []string{"rust"}}}
+	upstream := []FeedItem{
+		{Title: "Go 1.5", Link: "http://example.com/1", guid: "1"},
+		{Title: "Rust 1.0", Link: "http://example.com/2", guid: "2"},
+		{Title: "Go 1.6", Link: "http://example.com/3"},
+		{Title: "Go 1.7", Link: "http://example.com/4", guid: "4"},
+	}
+	known := map[string]bool{sourceGUID(source, "4"): true}
+	items := newSourceItems(source, known, upstream)
+	if len(items) != 2 || items[0].guid != sourceGUID(source, "1") || items[1].guid != sourceGUID(source, "http://example.com/3") {
+		t.Errorf("unexpected new items %#v", items)
+	}
+}
+
+func TestSourceGUIDsOutliveItems(t *testing.T) {
+	db, tx := beginTestTx(t)
+	defer db.Close()
+	defer tx.Rollback()
+	user, feedID := insertTestFeed(t, tx, false)
+	source := polledSource{FeedSource: FeedSource{FeedID: feedID, URL: "https://example.com/rss"}}
+	if err := tx.QueryRow("INSERT INTO feed_sources(feed_id, owner_id, url) VALUES($1, $2, $3) RETURNING id",
+		feedID, user.ID, source.URL).Scan(&source.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := []FeedItem{{Title: "Go 1.5", Link: "http://example.com/1", guid: "1"}}
+	items := newSourceItems(source, map[string]bool{}, upstream)
+	if err := recordSourceGUIDs(tx, source, items); err != nil {
+		t.Fatal(err)
+	}
+	fs := &Feeds{db: db}
+	items, _, err := fs.addItems(user, feedID, items, tx)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("expected item to be added, got %v, error %v", items, err)
+	}
+	if _, err := tx.Exec("DELETE FROM feed_items WHERE id=$1", items[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	known, err := sourceGUIDs(tx, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items := newSourceItems(source, known, upstream); len(items) != 0 {
+		t.Errorf("expected deleted item not to be copied again, got %#v", items)
+	}
+}
@@ -5,10 +5,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/OneOfOne/xxhash"
@@ -24,6 +23,78 @@ type Feed struct {
 	Description string     `json:"description"`
 	Items       []FeedItem `json:"items"`
 	ownerID     RecordID
+
+	// podcast metadata, emitted as itunes:* elements
+	ImageURL string `json:"imageURL"`
+	Author   string `json:"author"`
+	Category string `json:"category"`
+	Explicit bool   `json:"explicit"`
+
+	// Query is set for smart feeds, whose items are not stored directly
+	Query *SmartQuery `json:"query,omitempty"`
+
+	// MaxItems limits the live document to the newest items, older ones
+	// being served as archive pages. 0 means no limit.
+	MaxItems    int  `json:"maxItems"`
+	NewestFirst bool `json:"newestFirst"`
+
+	// NoFullText turns off the extraction of the article content of items
+	NoFullText bool `json:"noFullText"`
+
+	// HideDeadLinks leaves the items whose link is broken out of the feed
+	// documents
+	HideDeadLinks bool `json:"hideDeadLinks"`
+
+	// Snapshots turns on the archiving of a copy of the pages of new items
+	Snapshots bool `json:"snapshots"`
+
+	// TrackClicks points the item links of the feed documents to the api,
+	// which counts the clicks before redirecting
+	TrackClicks bool `json:"trackClicks"`
+
+	// Public feeds are served without a token, at a url made of the username
+	// of their owner and of their slug
+	Public bool   `json:"public"`
+	Slug   string `json:"slug"`
+
+	// Duplicates are the items that were not added because their link was
+	// already in the feed
+	Duplicates []FeedItem `json:"duplicates,omitempty"`
+}
+
+// SmartQuery selects the items of a smart feed among all the items of its
+// owner. Only the criteria that are set apply.
+type SmartQuery struct {
+	Tag        string     `json:"tag,omitempty"`
+	FeedIDs    []RecordID `json:"feedIDs,omitempty"`
+	MaxAgeDays int        `json:"maxAgeDays,omitempty"`
+	Domain     string     `json:"domain,omitempty"`
+}
+
+// domains are matched with LIKE, so they must not contain its wildcards
+var smartQueryDomainPattern = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)*$`)
+
+func smartQueryParam(q *SmartQuery) (interface{}, error) {
+	if q == nil {
+		return nil, nil
+	}
+	normalized := *q
+	normalized.Tag = normalizeTag(q.Tag)
+	normalized.Domain = strings.ToLower(strings.TrimSpace(q.Domain))
+	if normalized.Domain != "" && !smartQueryDomainPattern.MatchString(normalized.Domain) {
+		return nil, ErrInvalidSmartQuery
+	}
+	// the ids are cast to uuids when the query is run
+	for _, feedID := range normalized.FeedIDs {
+		if _, err := uuid.FromString(string(feedID)); err != nil {
+			return nil, ErrInvalidSmartQuery
+		}
+	}
+	data, err := json.Marshal(normalized)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode smart query %#v: %v", q, err)
+	}
+	return string(data), nil
 }
 
 type FeedItem struct {
@@ -33,16 +104,67 @@ type FeedItem struct {
 	Title       string   `json:"title"`
 	Description string   `json:"description"`
 	ownerID     RecordID
+
+	EnclosureURL    string `json:"enclosureURL"`
+	EnclosureType   string `json:"enclosureType"`
+	EnclosureLength int64  `json:"enclosureLength"`
+
+	Tags []string `json:"tags"`
+
+	// filled in from the page metadata when the item is saved with only a link
+	CanonicalURL  string `json:"canonicalURL"`
+	SiteName      string `json:"siteName"`
+	needsMetadata bool
+	guid          string    // set on items copied from an upstream feed
+	dateAdded     time.Time // set on imported items, defaults to now
+
+	// sanitized article content, extracted from the page of the link
+	ContentHTML string `json:"contentHTML"`
+}
+
+// Tag is one of the tags of a user's items, along with the number of items having it.
+type Tag struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
 }
 
 type Feeds struct {
-	config Config
-	db     *sql.DB
-	redis  *redis.Client
+	config    Config
+	db        *sql.DB
+	redis     *redis.Client
+	shortener Shortener
+	snapshots BlobStore // nil if snapshots are not enabled
+	hub       *websubHub
+	events    *eventStream
+	fetches   *fetchRecorder
+
+	enrichQueue chan enrichJob
 }
 
 func newFeeds(config Config, db *sql.DB, redisClient *redis.Client) (*Feeds, error) {
-	return &Feeds{config, db, redisClient}, nil
+	fs := &Feeds{config: config, db: db, redis: redisClient, hub: newWebSubHub(), events: newEventStream(),
+		fetches: newFetchRecorder(), enrichQueue: make(chan enrichJob, enrichQueueSize)}
+	shortener, err := newShortener(config, db)
+	if err != nil {
+		return nil, err
+	}
+	fs.shortener = shortener
+	if config.SnapshotsDir != "" {
+		snapshots, err := newFileBlobStore(config.SnapshotsDir)
+		if err != nil {
+			return nil, err
+		}
+		fs.snapshots = snapshots
+	}
+	fs.startSourcesPollLoop(sourcesPollCheckInterval)
+	fs.startLinkChecksLoop(linkChecksInterval)
+	fs.startWebSubDeleteExpiredLoop(websubDeleteExpiredCheck)
+	fs.startWebhookDeliveriesLoop(webhookDeliveriesInterval)
+	fs.startWebhookLogCleanupLoop(webhookLogCleanupInterval)
+	fs.startEventsSubscriber()
+	fs.startFetchStatsFlushLoop(fetchStatsFlushInterval)
+	fs.startEnrichWorkers(enrichWorkers)
+	return fs, nil
 }
 
 type FeedData struct {
@@ -55,20 +177,59 @@ type feedCacheHint struct {
 	id   RecordID
 }
 
-type formatQueryResults func(results []byte) []byte
+// FeedFormat identifies one of the representations a feed can be served as.
+type FeedFormat string
 
-type query struct {
-	cacheHint feedCacheHint
-	format    formatQueryResults
-	sql       string
+const (
+	FormatJSON     FeedFormat = "json"
+	FormatRSS      FeedFormat = "rss"
+	FormatAtom     FeedFormat = "atom"
+	FormatJSONFeed FeedFormat = "jsonfeed"
+	FormatOPML     FeedFormat = "opml"
+)
+
+var feedFormatQueries = map[FeedFormat]string{
+	FormatJSON:     "SELECT feed_json_object(feeds, $3::json) FROM feeds WHERE id=$1 AND owner_id=$2",
+	FormatRSS:      "SELECT feed_xml($1,$2,$3::json)",
+	FormatAtom:     "SELECT feed_atom($1,$2,$3::json)",
+	FormatJSONFeed: "SELECT feed_jsonfeed($1,$2,$3::json)",
 }
 
-func (fs *Feeds) GetJson(user User, id RecordID) (FeedData, error) {
-	return fs.findOne(query{cacheHint: feedCacheHint{user, id}, sql: "SELECT json FROM feed_json WHERE id=$1 and owner_id=$2"}, id, user.ID)
+// FeedOptions restricts or alters what a feed document contains.
+type FeedOptions struct {
+	// Tag, if set, only keeps the items having this tag
+	Tag string `json:"tag,omitempty"`
+	// Page selects one of the archive pages of a feed with a limited number
+	// of items, 1 being the oldest. 0 is the live document.
+	Page int `json:"page,omitempty"`
+	// BaseURL is what links between feed documents are built from
+	BaseURL string `json:"baseURL,omitempty"`
+	// PublicURL, set when serving a public feed, replaces the links to the
+	// documents of the feed, which embed its token
+	PublicURL string `json:"publicURL,omitempty"`
 }
 
-func (fs *Feeds) GetRss(user User, id RecordID) (FeedData, error) {
-	return fs.findOne(query{cacheHint: feedCacheHint{user, id}, sql: "SELECT feed_xml($1,$2)"}, id, user.ID)
+type formatQueryResults func(results []byte) []byte
+
+type query struct {
+	cacheHint  feedCacheHint
+	feedFormat FeedFormat
+	format     formatQueryResults
+	sql        string
+}
+
+func (fs *Feeds) Get(user User, id RecordID, feedFormat FeedFormat, opts FeedOptions) (FeedData, error) {
+	sql, ok := feedFormatQueries[feedFormat]
+	if !ok {
+		return FeedData{}, fmt.Errorf("unknown feed format %v", feedFormat)
+	}
+	opts.Tag = normalizeTag(opts.Tag)
+	opts.BaseURL = fs.config.PublicURL
+	optsJson, err := json.Marshal(opts)
+	if err != nil {
+		return FeedData{}, fmt.Errorf("unable to encode feed options %#v: %v", opts, err)
+	}
+	return fs.findOne(query{cacheHint: feedCacheHint{user, id}, feedFormat: feedFormat, sql: sql}, id, user.ID, string(optsJson))
 }
 
 func (fs *Feeds) GetAllJson(user User) (FeedData, error) {
@@ -79,7 +240,34 @@ func (fs *Feeds) GetAllJson(user User) (FeedData, error) {
 			return results
 		}
 	}
-	return fs.findMany(query{cacheHint: feedCacheHint{user: user}, format: format, sql: "SELECT json FROM feeds_json WHERE owner_id=$1"}, user.ID)
+	return fs.findMany(query{cacheHint: feedCacheHint{user: user}, feedFormat: FormatJSON, format: format, sql: "SELECT json FROM feeds_json WHERE owner_id=$1"}, user.ID)
+}
+
+func (fs *Feeds) GetTags(user User) (FeedData, error) {
+	sql := `SELECT COALESCE(json_agg(tags), '[]') FROM (
+		SELECT tag, count(*) AS count FROM feed_item_tags WHERE owner_id=$1 GROUP BY tag ORDER BY tag
+	) AS tags`
+	return fs.findOne(query{cacheHint: feedCacheHint{user: user}, feedFormat: FormatJSON, sql: sql}, user.ID)
+}
+
+// LookupItems returns the items of all the feeds of user that have the given
+// link, once normalized, each with the feed it belongs to.
+func (fs *Feeds) LookupItems(user User, link string) (FeedData, error) {
+	sql := `SELECT COALESCE(json_agg(matches), '[]') FROM (
+		SELECT
+			json_build_object('id', REPLACE(feeds.id::text, '-', ''), 'title', feeds.title, 'link', feeds.link) AS feed,
+			json_build_object('id', REPLACE(feed_items.id::text, '-', ''), 'feedID', REPLACE(feed_items.feed_id::text, '-', ''),
+				'link', feed_items.link, 'title', feed_items.title, 'date_added', feed_items.date_added,
+				'tags', feed_item_tag_list(feed_items.id)) AS item
+		FROM feed_items INNER JOIN feeds ON feeds.id=feed_items.feed_id
+		WHERE feed_items.owner_id=$1 AND (feed_items.normalized_link=$2 OR feed_items.link=$2)
+		ORDER BY feed_items.date_added
+	) AS matches`
+	return fs.findOne(query{cacheHint: feedCacheHint{user: user}, feedFormat: FormatJSON, sql: sql}, user.ID, normalizeLink(link))
+}
+
+func (fs *Feeds) GetAllOpml(user User) (FeedData, error) {
+	return fs.findOne(query{cacheHint: feedCacheHint{user: user}, feedFormat: FormatOPML, sql: "SELECT feeds_opml($1)"}, user.ID)
 }
 
 func (fs *Feeds) findOne(query query, args ...interface{}) (FeedData, error) {
@@ -92,7 +280,7 @@ func (fs *Feeds) findOne(query query, args ...interface{}) (FeedData, error) {
 }
 
 func (fs *Feeds) findMany(query query, args ...interface{}) (FeedData, error) {
-	cacheKey := makeCacheKey(query.sql, args)
+	cacheKey := makeCacheKey(query.feedFormat, query.sql, args)
 	bytes, etag, err := fs.getFromCache(cacheKey)
 	if err != nil {
 		return FeedData{}, err
@@ -117,14 +305,16 @@ func makeEtag() string {
 	return uuid.NewV4().String()
 }
 
-func makeCacheKey(query string, args []interface{}) string {
+// makeCacheKey builds a key unique to the format, query and arguments, so that
+// every representation of a feed gets its own cache entry and ETag.
+func makeCacheKey(feedFormat FeedFormat, query string, args []interface{}) string {
 	h := xxhash.NewS64(0XBABE)
 	h.Write([]byte(query))
 	for _, arg := range args {
 		h.Write([]byte{0})
 		h.Write([]byte(fmt.Sprintf("%v", arg)))
 	}
-	return fmt.Sprintf("query.%v", h.Sum64())
+	return fmt.Sprintf("query.%s.%v", feedFormat, h.Sum64())
 }
 
 func (fs *Feeds) getFromCache(cacheKey string) ([]byte, string, error) {
@@ -171,6 +361,22 @@ func (fs *Feeds) getFromDB(query query, args []interface{}) ([]byte, error) {
 
 func (fs *Feeds) invalidateFeedCache(cacheHint feedCacheHint) error {
 	rkeys := []string{reverseMapCacheKey(cacheHint), reverseMapCacheKey(feedCacheHint{user: cacheHint.user})}
+
+	// any change can affect the items selected by the user's smart feeds
+	smartFeedIDs, err := fs.smartFeedIDs(cacheHint.user)
+	if err != nil {
+		return err
+	}
+	for _, id := range smartFeedIDs {
+		if id != cacheHint.id {
+			rkeys = append(rkeys, reverseMapCacheKey(feedCacheHint{cacheHint.user, id}))
+			fs.notifyWebSub(id)
+		}
+	}
+	if cacheHint.id != "" {
+		fs.notifyWebSub(cacheHint.id)
+	}
+
 	script := `
 		local num_deleted = 0;
 		for i=1, #KEYS do
@@ -192,6 +398,24 @@ func (fs *Feeds) invalidateFeedCache(cacheHint feedCacheHint) error {
 	return nil
 }
 
+func (fs *Feeds) smartFeedIDs(user User) ([]RecordID, error) {
+	rows, err := fs.db.Query("SELECT id FROM feeds WHERE owner_id=$1 AND query IS NOT NULL", user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch smart feeds of %v: %v", user, err)
+	}
+	defer rows.Close()
+
+	ids := []RecordID{}
+	for rows.Next() {
+		var id RecordID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
 func (fs *Feeds) Create(user User, token string, feed *Feed) error {
 	if feed.ID == "" {
 		feed.ID = newID()
@@ -201,7 +425,21 @@ func (fs *Feeds) Create(user User, token string, feed *Feed) error {
 		feed.Items = []FeedItem{}
 	}
 
-	feed.Link = makeFeedURL(fs.config, feed, token)
+	if feed.Query != nil && len(feed.Items) > 0 {
+		return ErrSmartFeedItems
+	}
+	smartQuery, err := smartQueryParam(feed.Query)
+	if err != nil {
+		return err
+	}
+	if err := checkFeedSlug(user, feed); err != nil {
+		return err
+	}
+
+	feed.Link, err = fs.makeFeedURL(feed, token)
+	if err != nil {
+		return err
+	}
 	feed.ownerID = user.ID
 
 	tx, err := fs.db.Begin()
@@ -210,8 +448,12 @@ func (fs *Feeds) Create(user User, token string, feed *Feed) error {
 	}
 	defer tx.Rollback()
 
-	_, err = tx.Exec("INSERT INTO feeds(id,owner_id,title,link,description) VALUES($1,$2,$3,$4,$5)",
-		feed.ID, feed.ownerID, feed.Title, feed.Link, feed.Description)
+	_, err = tx.Exec(`INSERT INTO feeds(id,owner_id,title,link,description,image_url,author,category,explicit,query,
+			read_token,max_items,newest_first,no_full_text,hide_dead_links,snapshots,track_clicks,public,slug)
+		VALUES($1,$2,$3,$4,$5,NULLIF($6,''),NULLIF($7,''),NULLIF($8,''),$9,$10::jsonb,$11,NULLIF($12,0),$13,$14,$15,$16,$17,$18,NULLIF($19,''))`,
+		feed.ID, feed.ownerID, feed.Title, feed.Link, feed.Description, feed.ImageURL, feed.Author, feed.Category, feed.Explicit, smartQuery,
+		token, feed.MaxItems, feed.NewestFirst, feed.NoFullText, feed.HideDeadLinks, feed.Snapshots, feed.TrackClicks,
+		feed.Public, feed.Slug)
 	if err != nil {
 		if isUniqueError(err) {
 			return ErrUniqueViolation
@@ -220,38 +462,69 @@ func (fs *Feeds) Create(user User, token string, feed *Feed) error {
 		}
 	}
 
-	err = fs.addItems(user, feed.ID, feed.Items, tx)
+	feed.Items, feed.Duplicates, err = fs.addItems(user, feed.ID, feed.Items, tx)
+	if err != nil {
+		return err
+	}
+	ev, err := fs.emitEvent(tx, user, feed.ID, EventFeedCreated, newWebhookFeed(feed))
 	if err != nil {
 		return err
 	}
 
 	fs.invalidateFeedCache(feedCacheHint{user, feed.ID})
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fs.publishEvent(ev)
+	fs.enrichItemsLater(user, feed.Items)
+	return nil
 }
 
-func makeFeedURL(config Config, feed *Feed, token string) string {
-	longUrl := config.PublicURL + "/feeds/" + string(feed.ID) + "/rss?_tok=" + token
-	shortUrl, err := shortenUrl(config, longUrl)
-	if err != nil { // fallback to long url
-		log.Println(err)
-		return longUrl
-	} else {
-		return shortUrl
+func (fs *Feeds) makeFeedURL(feed *Feed, token string) (string, error) {
+	longUrl := fs.config.PublicURL + "/feeds/" + string(feed.ID) + "/rss?_tok=" + token
+	shortUrl, err := fs.shortener.Shorten(longUrl)
+	if err != nil {
+		return "", fmt.Errorf("unable to shorten feed url: %v", err)
 	}
-
+	return shortUrl, nil
 }
 
 func (fs *Feeds) Delete(user User, feedID RecordID) error {
+	snapshots, err := scanSnapshotKeys(fs.db.Query(
+		"SELECT snapshot_key FROM feed_items WHERE feed_id=$1 AND owner_id=$2 AND snapshot_key IS NOT NULL", feedID, user.ID))
+	if err != nil {
+		return err
+	}
 	res, err := fs.db.Exec("DELETE FROM feeds WHERE id=$1 AND owner_id=$2", feedID, user.ID)
 	if err != nil {
 		return err
 	}
 	fs.invalidateFeedCache(feedCacheHint{user, feedID})
-	return checkRowsAffected(res, 1)
+	if err := checkRowsAffected(res, 1); err != nil {
+		return err
+	}
+	fs.deleteSnapshots(snapshots)
+	// the webhooks of the feed itself were deleted along with it
+	ev, err := fs.emitEvent(fs.db, user, feedID, EventFeedDeleted, deletedFeed{feedID})
+	if err != nil {
+		return err
+	}
+	fs.publishEvent(ev)
+	return nil
 }
 
 func (fs *Feeds) Update(user User, feed *Feed) error {
+	if feed.Query != nil && len(feed.Items) > 0 {
+		return ErrSmartFeedItems
+	}
+	smartQuery, err := smartQueryParam(feed.Query)
+	if err != nil {
+		return err
+	}
+	if err := checkFeedSlug(user, feed); err != nil {
+		return err
+	}
 
 	tx, err := fs.db.Begin()
 	if err != nil {
@@ -259,8 +532,19 @@ func (fs *Feeds) Update(user User, feed *Feed) error {
 	}
 	defer tx.Rollback()
 
-	res, err := tx.Exec("UPDATE feeds set title=$1 WHERE id=$2 AND owner_id=$3", feed.Title, feed.ID, user.ID)
+	if err := fs.keepFormerSlug(user, feed, tx); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`UPDATE feeds set title=$1,image_url=NULLIF($2,''),author=NULLIF($3,''),category=NULLIF($4,''),explicit=$5,query=$6::jsonb,
+			max_items=NULLIF($7,0),newest_first=$8,no_full_text=$9,hide_dead_links=$10,snapshots=$11,
+			track_clicks=$12,public=$13,slug=NULLIF($14,'')
+		WHERE id=$15 AND owner_id=$16`,
+		feed.Title, feed.ImageURL, feed.Author, feed.Category, feed.Explicit, smartQuery, feed.MaxItems, feed.NewestFirst, feed.NoFullText,
+		feed.HideDeadLinks, feed.Snapshots, feed.TrackClicks, feed.Public, feed.Slug, feed.ID, user.ID)
 	if err != nil {
+		if isUniqueError(err) {
+			return ErrUniqueViolation
+		}
 		return err
 	}
 	err = checkRowsAffected(res, 1)
@@ -268,143 +552,466 @@ func (fs *Feeds) Update(user User, feed *Feed) error {
 		return err
 	}
 
+	var replaced itemsReplacement
 	if feed.Items != nil {
-		err = fs.replaceItems(user, feed.ID, feed.Items, tx)
+		replaced, err = fs.replaceItems(user, feed.ID, feed.Items, tx)
 		if err != nil {
 			return err
 		}
+		feed.Items, feed.Duplicates = replaced.items, replaced.duplicates
+	}
+	ev, err := fs.emitEvent(tx, user, feed.ID, EventFeedUpdated, newWebhookFeed(feed))
+	if err != nil {
+		return err
 	}
 	fs.invalidateFeedCache(feedCacheHint{user, feed.ID})
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fs.deleteSnapshots(replaced.snapshots)
+	fs.publishEvent(ev)
+	fs.enrichItemsLater(user, replaced.added)
+	return nil
 }
 
-func (fs *Feeds) replaceItems(user User, feedID RecordID, items []FeedItem, tx *sql.Tx) error {
-	_, err := tx.Exec("DELETE FROM feed_items WHERE feed_id = $1 AND owner_id = $2", feedID, user.ID)
+// itemsReplacement is the outcome of replacing the items of a feed
+type itemsReplacement struct {
+	items      []FeedItem // the updated and added items
+	added      []FeedItem
+	duplicates []FeedItem
+	snapshots  []string // of the deleted items, to delete once committed
+}
+
+// replaceItems makes the given items the items of a feed. Those whose link is
+// already in the feed are updated in place, so that they keep their clicks,
+// link health and snapshot. The others are added, and the items of the feed
+// that are not given are deleted.
+func (fs *Feeds) replaceItems(user User, feedID RecordID, items []FeedItem, tx *sql.Tx) (itemsReplacement, error) {
+	existing, err := feedItemIDs(tx, user, feedID)
 	if err != nil {
-		return err
+		return itemsReplacement{}, err
+	}
+
+	replaced := itemsReplacement{items: []FeedItem{}}
+	kept := map[RecordID]bool{}
+	keptIDs := []string{}
+	fresh := []FeedItem{}
+	for _, item := range items {
+		item.Link = normalizeLink(item.Link)
+		id, ok := existing[item.Link]
+		if !ok {
+			fresh = append(fresh, item)
+			continue
+		} else if kept[id] {
+			replaced.duplicates = append(replaced.duplicates, item)
+			continue
+		}
+		kept[id] = true
+		keptIDs = append(keptIDs, string(id))
+
+		item.ID = id
+		item.FeedID = feedID
+		item.ownerID = user.ID
+		if err := fs.updateReplacedItem(user, &item, tx); err != nil {
+			return itemsReplacement{}, err
+		}
+		replaced.items = append(replaced.items, item)
+	}
+
+	replaced.snapshots, err = scanSnapshotKeys(tx.Query(`DELETE FROM feed_items
+		WHERE feed_id=$1 AND owner_id=$2 AND NOT (id = ANY($3::uuid[]))
+		RETURNING snapshot_key`,
+		feedID, user.ID, "{"+strings.Join(keptIDs, ",")+"}"))
+	if err != nil {
+		return itemsReplacement{}, err
 	}
 
-	return fs.addItems(user, feedID, items, tx)
+	added, duplicates, err := fs.addItems(user, feedID, fresh, tx)
+	if err != nil {
+		return itemsReplacement{}, err
+	}
+	replaced.items = append(replaced.items, added...)
+	replaced.added = added
+	replaced.duplicates = append(replaced.duplicates, duplicates...)
+	return replaced, nil
+}
+
+// feedItemIDs returns the ids of the items of a feed by their links, as saved
+// and as resolved after following redirects.
+func feedItemIDs(tx *sql.Tx, user User, feedID RecordID) (map[string]RecordID, error) {
+	rows, err := tx.Query("SELECT id, link, normalized_link FROM feed_items WHERE feed_id=$1 AND owner_id=$2", feedID, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query items of feed %v: %v", feedID, err)
+	}
+	defer rows.Close()
+
+	ids := map[string]RecordID{}
+	for rows.Next() {
+		var id RecordID
+		var link, normalizedLink string
+		if err := rows.Scan(&id, &link, &normalizedLink); err != nil {
+			return nil, err
+		}
+		ids[link] = id
+		ids[normalizedLink] = id
+	}
+	return ids, rows.Err()
 }
 
-func (fs *Feeds) addItems(user User, feedID RecordID, items []FeedItem, tx *sql.Tx) error {
+// updateReplacedItem updates the fields of an item that is kept by a
+// replacement. An item given without a title keeps its current one.
+func (fs *Feeds) updateReplacedItem(user User, item *FeedItem, tx *sql.Tx) error {
+	err := tx.QueryRow(`UPDATE feed_items SET title=coalesce(NULLIF($1,''), title),description=$2,
+			enclosure_url=NULLIF($3,''),enclosure_type=NULLIF($4,''),enclosure_length=NULLIF($5,0),date_modified=NOW()
+		WHERE id=$6 AND owner_id=$7
+		RETURNING title`,
+		item.Title, item.Description, item.EnclosureURL, item.EnclosureType, item.EnclosureLength, item.ID, user.ID).Scan(&item.Title)
+	if err != nil {
+		return fmt.Errorf("unable to update item %v: %v", item.ID, err)
+	}
+	if item.Tags == nil {
+		item.Tags = []string{}
+	}
+	return fs.replaceTags(user, item, tx)
+}
+
+// items are inserted by batches, to stay below the limit on the number of
+// parameters of a statement
+const addItemsBatchSize = 500
+
+// addItems inserts the items into the feed, after normalizing their links.
+// Items whose link is already in the feed, or earlier in items, are skipped.
+// It returns the added items, with their missing fields set, and the skipped
+// ones.
+func (fs *Feeds) addItems(user User, feedID RecordID, items []FeedItem, tx *sql.Tx) ([]FeedItem, []FeedItem, error) {
+	added := []FeedItem{}
+	duplicates := []FeedItem{}
 	if len(items) == 0 {
-		return nil
+		return added, duplicates, nil
+	}
+
+	links, err := feedLinks(tx, user, feedID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, item := range items {
+		item.Link = normalizeLink(item.Link)
+		if links[item.Link] {
+			duplicates = append(duplicates, item)
+			continue
+		}
+		links[item.Link] = true
+
+		//set missing fields
+		if item.ID == "" {
+			item.ID = newID()
+		}
+		item.FeedID = feedID
+		item.ownerID = user.ID
+		if item.Title == "" {
+			item.Title = item.Link // placeholder until the page metadata is fetched
+			item.needsMetadata = true
+		}
+		added = append(added, item)
+	}
+
+	for start := 0; start < len(added); start += addItemsBatchSize {
+		end := start + addItemsBatchSize
+		if end > len(added) {
+			end = len(added)
+		}
+		if err := fs.insertItems(user, feedID, added[start:end], tx); err != nil {
+			return nil, nil, err
+		}
+	}
+	return added, duplicates, nil
+}
+
+// feedLinks returns the links of the items of a feed, as saved and as
+// resolved after following redirects.
+func feedLinks(tx *sql.Tx, user User, feedID RecordID) (map[string]bool, error) {
+	rows, err := tx.Query("SELECT link, normalized_link FROM feed_items WHERE feed_id=$1 AND owner_id=$2", feedID, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query links of feed %v: %v", feedID, err)
 	}
+	defer rows.Close()
 
+	links := map[string]bool{}
+	for rows.Next() {
+		var link, normalizedLink string
+		if err := rows.Scan(&link, &normalizedLink); err != nil {
+			return nil, err
+		}
+		links[link] = true
+		links[normalizedLink] = true
+	}
+	return links, rows.Err()
+}
+
+func (fs *Feeds) insertItems(user User, feedID RecordID, items []FeedItem, tx *sql.Tx) error {
 	// build query to insert multiple items.
 	// we use the owner_id constraint to ensure that we can't add items to feeds
 	// of another user: if the owner_id in feeds doesn't match, (SELECT owner_id FROM owned_feed)
-	// will be null and inserts will be rejected
+	// will be null and inserts will be rejected. Smart feeds are excluded the same way.
 	query := bytes.Buffer{}
 	query.WriteString(`
-		WITH owned_feed AS (SELECT owner_id FROM feeds WHERE id = $1 AND owner_id = $2)
-			INSERT INTO feed_items(id, feed_id, owner_id, link, title, description) VALUES
+		WITH owned_feed AS (SELECT owner_id FROM feeds WHERE id = $1 AND owner_id = $2 AND query IS NULL)
+			INSERT INTO feed_items(id, feed_id, owner_id, link, normalized_link, title, description, enclosure_url, enclosure_type, enclosure_length, guid,
+				date_added, date_modified) VALUES
 	`)
 	params := []interface{}{feedID, user.ID}
 	itemCount := len(items)
 	for idx, item := range items {
-		//set missing fields
-		if item.ID == "" {
-			item.ID = newID()
-		}
-		item.FeedID = feedID
-		item.ownerID = user.ID
-		items[idx] = item //put it back in array so caller sees updated values
-
 		//add statement line and params
 		nextParam := len(params) + 1
-		fmt.Fprintf(&query, "($%d, $%d, (SELECT owner_id FROM owned_feed), $%d, $%d, $%d)",
-			nextParam, nextParam+1, nextParam+2, nextParam+3, nextParam+4)
-		params = append(params, item.ID, feedID, item.Link, item.Title, item.Description)
+		var dateAdded *time.Time
+		if !item.dateAdded.IsZero() {
+			dateAdded = &item.dateAdded
+		}
+		fmt.Fprintf(&query, "($%d, $%d, (SELECT owner_id FROM owned_feed), $%d, $%d, $%d, $%d, NULLIF($%d,''), NULLIF($%d,''), NULLIF($%d,0), NULLIF($%d,''),"+
+			" COALESCE($%d::timestamp, timeofday()::TIMESTAMP), COALESCE($%d::timestamp, timeofday()::TIMESTAMP))",
+			nextParam, nextParam+1, nextParam+2, nextParam+2, nextParam+3, nextParam+4, nextParam+5, nextParam+6, nextParam+7, nextParam+8, nextParam+9, nextParam+9)
+		params = append(params, item.ID, feedID, item.Link, item.Title, item.Description,
+			item.EnclosureURL, item.EnclosureType, item.EnclosureLength, item.guid, dateAdded)
 		if idx < itemCount-1 {
 			query.WriteString(",")
 		}
 	}
 	res, err := tx.Exec(query.String(), params...)
 	if err != nil {
+		if isUniqueError(err) {
+			return ErrDuplicateItem
+		}
 		return err
 	}
-	return checkRowsAffected(res, int64(itemCount))
+	if err := checkRowsAffected(res, int64(itemCount)); err != nil {
+		return err
+	}
+
+	return fs.addTags(user, items, tx)
 }
 
-func (fs *Feeds) AddItem(user User, item *FeedItem) error {
-	tx, err := fs.db.Begin()
+func (fs *Feeds) addTags(user User, items []FeedItem, tx *sql.Tx) error {
+	query := bytes.Buffer{}
+	query.WriteString("INSERT INTO feed_item_tags(item_id, owner_id, tag) VALUES ")
+	params := []interface{}{user.ID}
+	for idx := range items {
+		items[idx].Tags = normalizeTags(items[idx].Tags)
+		for _, tag := range items[idx].Tags {
+			if len(params) > 1 {
+				query.WriteString(",")
+			}
+			fmt.Fprintf(&query, "($%d, $1, $%d)", len(params)+1, len(params)+2)
+			params = append(params, items[idx].ID, tag)
+		}
+	}
+
+	if len(params) == 1 {
+		return nil
+	}
+
+	_, err := tx.Exec(query.String(), params...)
+	return err
+}
+
+func (fs *Feeds) replaceTags(user User, item *FeedItem, tx *sql.Tx) error {
+	_, err := tx.Exec("DELETE FROM feed_item_tags WHERE item_id = $1 AND owner_id = $2", item.ID, user.ID)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
 
 	items := []FeedItem{*item}
-	err = fs.addItems(user, item.FeedID, items, tx)
+	err = fs.addTags(user, items, tx)
 	*item = items[0]
-	fs.invalidateFeedCache(feedCacheHint{user, item.FeedID})
+	return err
+}
 
-	return tx.Commit()
+func normalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
 }
 
-func (fs *Feeds) UpdateItem(user User, item FeedItem) error {
-	res, err := fs.db.Exec("UPDATE feed_items set link=$1,title=$2,description=$3,date_modified=NOW() WHERE id=$4 AND owner_id=$5",
-		item.Link, item.Title, item.Description, item.ID, user.ID)
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func (fs *Feeds) AddItem(user User, item *FeedItem) error {
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	items, duplicates, err := fs.addItems(user, item.FeedID, []FeedItem{*item}, tx)
+	if err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		return ErrDuplicateItem
+	}
+	*item = items[0]
+	ev, err := fs.emitEvent(tx, user, item.FeedID, EventItemAdded, item)
 	if err != nil {
 		return err
 	}
 	fs.invalidateFeedCache(feedCacheHint{user, item.FeedID})
 
-	return checkRowsAffected(res, 1)
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fs.publishEvent(ev)
+	fs.enrichItemsLater(user, items)
+	return nil
 }
 
-func (fs *Feeds) DeleteItem(user User, feedID RecordID, itemID RecordID) error {
-	res, err := fs.db.Exec("DELETE FROM feed_items WHERE id=$1 AND owner_id=$2", itemID, user.ID)
+// ImportItems adds the items to the feed, skipping those whose link is
+// already in the feed. It returns the added items and the skipped ones.
+func (fs *Feeds) ImportItems(user User, feedID RecordID, items []FeedItem) ([]FeedItem, []FeedItem, error) {
+	tx, err := fs.db.Begin()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	fs.invalidateFeedCache(feedCacheHint{user, feedID})
-	return checkRowsAffected(res, 1)
-}
+	defer tx.Rollback()
 
-func checkRowsAffected(res sql.Result, expected int64) error {
-	actual, err := res.RowsAffected()
+	added, duplicates, err := fs.addItems(user, feedID, items, tx)
 	if err != nil {
-		return fmt.Errorf("Could not check rows affected: %v", err)
+		return nil, nil, err
 	}
-	if actual != expected {
-		return fmt.Errorf("Unexpected result: expected %v, got %v", expected, actual)
+	evs, err := fs.emitItemsAdded(tx, user, feedID, added)
+	if err != nil {
+		return nil, nil, err
 	}
-	return nil
+	fs.invalidateFeedCache(feedCacheHint{user, feedID})
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	for _, ev := range evs {
+		fs.publishEvent(ev)
+	}
+	fs.enrichItemsLater(user, added)
+	return added, duplicates, nil
 }
 
-func shortenUrl(config Config, longUrl string) (string, error) {
+// FindByTitle returns the feed with the given title, regardless of case.
+// Smart feeds are not considered.
+func (fs *Feeds) FindByTitle(user User, title string) (Feed, error) {
+	feed := Feed{Title: title, ownerID: user.ID}
+	err := fs.db.QueryRow("SELECT id, title, link FROM feeds WHERE owner_id=$1 AND lower(title)=lower($2) AND query IS NULL", user.ID, title).
+		Scan(&feed.ID, &feed.Title, &feed.Link)
+	if err == sql.ErrNoRows {
+		return Feed{}, ErrNotFound
+	} else if err != nil {
+		return Feed{}, err
+	}
+	return feed, nil
+}
 
-	url := fmt.Sprintf("https://api-ssl.bitly.com/v3/user/link_save?access_token=%s&longUrl=%s", config.BitlyAPIKey, url.QueryEscape(longUrl))
-	resp, err := http.Get(url)
+func (fs *Feeds) UpdateItem(user User, item FeedItem) error {
+	tx, err := fs.db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("shortenUrl: failed to exec request %v: %v", url, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var formerLink string
+	err = tx.QueryRow("SELECT link FROM feed_items WHERE id=$1 AND owner_id=$2 FOR UPDATE", item.ID, user.ID).Scan(&formerLink)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	item.Link = normalizeLink(item.Link)
+	// a new link has to be resolved and checked again
+	res, err := tx.Exec(`UPDATE feed_items set link=$1,normalized_link=CASE WHEN link=$1 THEN normalized_link ELSE $1 END,
+		title=$2,description=$3,
+		enclosure_url=NULLIF($4,''),enclosure_type=NULLIF($5,''),enclosure_length=NULLIF($6,0),date_modified=NOW(),
+		link_state=CASE WHEN link=$1 THEN link_state END, link_failures=CASE WHEN link=$1 THEN link_failures ELSE 0 END,
+		link_next_check=CASE WHEN link=$1 THEN link_next_check ELSE NOW() END
+		WHERE id=$7 AND owner_id=$8`,
+		item.Link, item.Title, item.Description, item.EnclosureURL, item.EnclosureType, item.EnclosureLength, item.ID, user.ID)
+	if err != nil {
+		if isUniqueError(err) {
+			return ErrDuplicateItem
+		}
+		return err
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	if err := checkRowsAffected(res, 1); err != nil {
+		return err
+	}
+
+	if item.Tags != nil {
+		if err := fs.replaceTags(user, &item, tx); err != nil {
+			return err
+		}
+	}
+	ev, err := fs.emitEvent(tx, user, item.FeedID, EventItemUpdated, item)
 	if err != nil {
-		return "", fmt.Errorf("shortenUrl: failed to read request response to %v: %v", url, err)
+		return err
 	}
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("shortenUrl: request %v returned %v status, body %s", url, resp.StatusCode, string(body))
+	fs.invalidateFeedCache(feedCacheHint{user, item.FeedID})
+
+	if err := tx.Commit(); err != nil {
+		return err
 	}
+	fs.publishEvent(ev)
+	if item.Link != formerLink {
+		fs.enrichItemsLater(user, []FeedItem{item})
+	}
+	return nil
+}
 
-	var shortenerRes struct {
-		Data struct{ Link_Save struct{ Link string } }
+func (fs *Feeds) DeleteItem(user User, feedID RecordID, itemID RecordID) error {
+	var snapshot sql.NullString
+	err := fs.db.QueryRow("DELETE FROM feed_items WHERE id=$1 AND owner_id=$2 AND feed_id=$3 RETURNING snapshot_key",
+		itemID, user.ID, feedID).Scan(&snapshot)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
 	}
-	err = json.Unmarshal(body, &shortenerRes)
+	ev, err := fs.emitEvent(fs.db, user, feedID, EventItemDeleted, deletedItem{itemID, feedID})
 	if err != nil {
-		return "", fmt.Errorf("shortenUrl: request %v returned unparsable body %v: %v", url, string(body), err)
+		return err
+	}
+	fs.publishEvent(ev)
+	fs.invalidateFeedCache(feedCacheHint{user, feedID})
+	if snapshot.Valid {
+		fs.deleteSnapshots([]string{snapshot.String})
 	}
+	return nil
+}
 
-	shortUrl := shortenerRes.Data.Link_Save.Link
-	if shortUrl == "" {
-		return "", fmt.Errorf("shortenUrl: request %v returned unexpected body %v: parsed: %#v", url, string(body), shortenerRes)
+// checkFeedOwner returns ErrNotFound unless the feed belongs to the user.
+func (fs *Feeds) checkFeedOwner(user User, feedID RecordID) error {
+	var exists bool
+	err := fs.db.QueryRow("SELECT true FROM feeds WHERE id=$1 AND owner_id=$2", feedID, user.ID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
 	}
+	return err
+}
 
-	return shortUrl, nil
+func checkRowsAffected(res sql.Result, expected int64) error {
+	actual, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Could not check rows affected: %v", err)
+	}
+	if actual != expected {
+		return fmt.Errorf("Unexpected result: expected %v, got %v", expected, actual)
+	}
+	return nil
 }
 
 func trace(label string) (string, time.Time) {
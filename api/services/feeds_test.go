@@ -0,0 +1,62 @@
+package services
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// beginTestTx starts a transaction on the database of the environment, which
+// the test rolls back, or skips the test if there is no database.
+func beginTestTx(t *testing.T) (*sql.DB, *sql.Tx) {
+	config, _ := loadConfigFromEnv()
+	db, err := setupDB(config)
+	if err != nil {
+		t.Skipf("no database to test with: %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return db, tx
+}
+
+// insertTestFeed creates a user and a feed of theirs.
+func insertTestFeed(t *testing.T, tx *sql.Tx, public bool) (User, RecordID) {
+	user := User{Email: "alice.smith@example.com", Username: "alice"}
+	err := tx.QueryRow(`INSERT INTO users(email, password, username) VALUES($1, 'secret', $2) RETURNING id`,
+		user.Email, user.Username).Scan(&user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var feedID RecordID
+	err = tx.QueryRow(`INSERT INTO feeds(owner_id, link, title, public, slug) VALUES($1, 'https://example.com', 'News', $2, 'news')
+		RETURNING id`, user.ID, public).Scan(&feedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, feedID
+}
+
+func TestSmartQueryParam(t *testing.T) {
+	param, err := smartQueryParam(&SmartQuery{Tag: " Go ", Domain: "Example.COM", FeedIDs: []RecordID{"0b1f6d6a7c3e4d2f9a8b7c6d5e4f3a2b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"tag":"go","feedIDs":["0b1f6d6a7c3e4d2f9a8b7c6d5e4f3a2b"],"domain":"example.com"}`
+	if param != expected {
+		t.Errorf("expected %v, got %v", expected, param)
+	}
+
+	invalid := []SmartQuery{
+		{FeedIDs: []RecordID{"not-an-id"}},
+		{Domain: "%.com"},
+		{Domain: "a_b.com"},
+		{Domain: "example..com"},
+	}
+	for _, q := range invalid {
+		if _, err := smartQueryParam(&q); err != ErrInvalidSmartQuery {
+			t.Errorf("expected %+v to be invalid, got %v", q, err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	fetchStatsFlushInterval = time.Minute
+	fetchStatsDays          = 30
+	fetchStatsMaxUserAgent  = 512
+)
+
+// aggregators report how many of their users follow a feed in their user
+// agent, e.g. "Feedly/1.0 (+http://www.feedly.com/fetcher.html; 42 subscribers)"
+var reportedSubscribersPattern = regexp.MustCompile(`(?i)\b(\d+)\s+(subscribers?|readers?)\b`)
+
+// FeedSubscribers is the estimated number of subscribers of a feed: the
+// subscribers reported by aggregators, plus one for every other client that
+// fetched the feed, as identified by its token and user agent.
+type FeedSubscribers struct {
+	FeedID      RecordID      `json:"feedID"`
+	Subscribers int           `json:"subscribers"`
+	Days        []FetchDay    `json:"days"`
+	Fetchers    []FeedFetcher `json:"fetchers"`
+}
+
+// FetchDay is the daily rollup of the fetches of a feed.
+type FetchDay struct {
+	Date        string `json:"date"`
+	Subscribers int    `json:"subscribers"`
+	Fetches     int    `json:"fetches"`
+	NotModified int    `json:"notModified"`
+}
+
+// FeedFetcher is a client that fetched a feed today or yesterday.
+// Aggregators report their number of subscribers.
+type FeedFetcher struct {
+	UserAgent           string `json:"userAgent"`
+	ReportedSubscribers int    `json:"reportedSubscribers,omitempty"`
+	Fetches             int    `json:"fetches"`
+}
+
+type fetchKey struct {
+	feedID    RecordID
+	day       string
+	token     string // hash of the token, which is a secret
+	userAgent string // with the reported subscribers replaced by N
+}
+
+type fetchCounts struct {
+	fetches             int
+	notModified         int
+	reportedSubscribers int
+}
+
+// fetchRecorder counts the fetches of feed documents in memory, until they
+// are added to the daily rollups.
+type fetchRecorder struct {
+	mutex  sync.Mutex
+	counts map[fetchKey]*fetchCounts
+}
+
+func newFetchRecorder() *fetchRecorder {
+	return &fetchRecorder{counts: map[fetchKey]*fetchCounts{}}
+}
+
+// parseFetcherUserAgent separates the number of subscribers an aggregator
+// reports from its user agent.
+func parseFetcherUserAgent(userAgent string) (string, int) {
+	if len(userAgent) > fetchStatsMaxUserAgent {
+		userAgent = userAgent[:fetchStatsMaxUserAgent]
+	}
+	match := reportedSubscribersPattern.FindStringSubmatchIndex(userAgent)
+	if match == nil {
+		return userAgent, 0
+	}
+	subscribers, err := strconv.Atoi(userAgent[match[2]:match[3]])
+	if err != nil {
+		return userAgent, 0
+	}
+	return userAgent[:match[2]] + "N" + userAgent[match[3]:], subscribers
+}
+
+func hashFetchToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:8])
+}
+
+// RecordFetch counts a fetch of a document of a feed, notModified being true
+// if it was answered with a 304.
+func (fs *Feeds) RecordFetch(feedID RecordID, token string, userAgent string, notModified bool) {
+	fs.fetches.record(feedID, token, userAgent, notModified, time.Now().UTC())
+}
+
+func (recorder *fetchRecorder) record(feedID RecordID, token string, userAgent string, notModified bool, now time.Time) {
+	userAgent, subscribers := parseFetcherUserAgent(userAgent)
+	key := fetchKey{feedID: feedID, day: now.Format("2006-01-02"), token: hashFetchToken(token), userAgent: userAgent}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	counts := recorder.counts[key]
+	if counts == nil {
+		counts = &fetchCounts{}
+		recorder.counts[key] = counts
+	}
+	counts.fetches++
+	if notModified {
+		counts.notModified++
+	}
+	if subscribers > counts.reportedSubscribers {
+		counts.reportedSubscribers = subscribers
+	}
+}
+
+// take returns the counts recorded so far, and starts over.
+func (recorder *fetchRecorder) take() map[fetchKey]*fetchCounts {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	counts := recorder.counts
+	recorder.counts = map[fetchKey]*fetchCounts{}
+	return counts
+}
+
+func (fs *Feeds) startFetchStatsFlushLoop(interval time.Duration) {
+	go func() {
+		tick := time.Tick(interval)
+		for range tick {
+			for key, counts := range fs.fetches.take() {
+				if err := fs.saveFetchCounts(key, counts); err != nil {
+					log.Printf("unable to save fetches of feed %v: %v", key.feedID, err)
+				}
+			}
+		}
+	}()
+}
+
+// saveFetchCounts adds counts to the rollup of their day. Another instance
+// may create the rollup at the same time, in which case it is updated.
+func (fs *Feeds) saveFetchCounts(key fetchKey, counts *fetchCounts) error {
+	for attempt := 1; ; attempt++ {
+		res, err := fs.db.Exec(`UPDATE feed_fetch_stats SET fetches = fetches + $1, not_modified = not_modified + $2,
+				reported_subscribers = NULLIF(GREATEST(coalesce(reported_subscribers, 0), $3), 0)
+			WHERE feed_id=$4 AND day=$5 AND token_hash=$6 AND user_agent=$7`,
+			counts.fetches, counts.notModified, counts.reportedSubscribers, key.feedID, key.day, key.token, key.userAgent)
+		if err != nil {
+			return err
+		}
+		if updated, err := res.RowsAffected(); err != nil || updated > 0 {
+			return err
+		}
+		_, err = fs.db.Exec(`INSERT INTO feed_fetch_stats(feed_id, day, token_hash, user_agent, fetches, not_modified, reported_subscribers)
+			SELECT id, $2, $3, $4, $5, $6, NULLIF($7, 0) FROM feeds WHERE id=$1`,
+			key.feedID, key.day, key.token, key.userAgent, counts.fetches, counts.notModified, counts.reportedSubscribers)
+		if err == nil || !isUniqueError(err) || attempt >= 2 {
+			return err
+		}
+	}
+}
+
+// GetSubscribers estimates the subscribers of a feed from the fetches of its
+// documents. The estimate is the highest of the last two days, since the
+// clients that poll daily may not have come by yet today.
+func (fs *Feeds) GetSubscribers(user User, feedID RecordID) (FeedSubscribers, error) {
+	if err := fs.checkFeedOwner(user, feedID); err != nil {
+		return FeedSubscribers{}, err
+	}
+	subscribers := FeedSubscribers{FeedID: feedID, Days: []FetchDay{}, Fetchers: []FeedFetcher{}}
+
+	rows, err := fs.db.Query(`SELECT to_char(day, 'YYYY-MM-DD'), sum(coalesce(reported_subscribers, 1)), sum(fetches), sum(not_modified)
+		FROM feed_fetch_stats WHERE feed_id=$1 AND day > current_date - $2::int
+		GROUP BY day ORDER BY day`,
+		feedID, fetchStatsDays)
+	if err != nil {
+		return FeedSubscribers{}, fmt.Errorf("unable to query fetches of feed %v: %v", feedID, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day FetchDay
+		if err := rows.Scan(&day.Date, &day.Subscribers, &day.Fetches, &day.NotModified); err != nil {
+			return FeedSubscribers{}, err
+		}
+		subscribers.Days = append(subscribers.Days, day)
+	}
+	if err := rows.Err(); err != nil {
+		return FeedSubscribers{}, err
+	}
+	subscribers.Subscribers = estimateSubscribers(subscribers.Days, time.Now().UTC())
+
+	rows, err = fs.db.Query(`SELECT user_agent, coalesce(max(reported_subscribers), 0), sum(fetches)
+		FROM feed_fetch_stats WHERE feed_id=$1 AND day >= current_date - 1
+		GROUP BY user_agent ORDER BY coalesce(max(reported_subscribers), 0) DESC, sum(fetches) DESC`,
+		feedID)
+	if err != nil {
+		return FeedSubscribers{}, fmt.Errorf("unable to query fetchers of feed %v: %v", feedID, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fetcher FeedFetcher
+		if err := rows.Scan(&fetcher.UserAgent, &fetcher.ReportedSubscribers, &fetcher.Fetches); err != nil {
+			return FeedSubscribers{}, err
+		}
+		subscribers.Fetchers = append(subscribers.Fetchers, fetcher)
+	}
+	return subscribers, rows.Err()
+}
+
+func estimateSubscribers(days []FetchDay, now time.Time) int {
+	today := now.Format("2006-01-02")
+	yesterday := now.AddDate(0, 0, -1).Format("2006-01-02")
+	estimate := 0
+	for _, day := range days {
+		if (day.Date == today || day.Date == yesterday) && day.Subscribers > estimate {
+			estimate = day.Subscribers
+		}
+	}
+	return estimate
+}
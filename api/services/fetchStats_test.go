@@ -0,0 +1,57 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFetcherUserAgent(t *testing.T) {
+	tests := []struct {
+		userAgent   string
+		expected    string
+		subscribers int
+	}{
+		{"Feedly/1.0 (+http://www.feedly.com/fetcher.html; 42 subscribers; like FeedFetcher-Google)",
+			"Feedly/1.0 (+http://www.feedly.com/fetcher.html; N subscribers; like FeedFetcher-Google)", 42},
+		{"NewsBlur Feed Fetcher - 1 subscriber - https://www.newsblur.com/site/123", "NewsBlur Feed Fetcher - N subscriber - https://www.newsblur.com/site/123", 1},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", 0},
+	}
+	for _, test := range tests {
+		userAgent, subscribers := parseFetcherUserAgent(test.userAgent)
+		if userAgent != test.expected || subscribers != test.subscribers {
+			t.Errorf("expected %q to be parsed as %q and %v subscribers, got %q and %v",
+				test.userAgent, test.expected, test.subscribers, userAgent, subscribers)
+		}
+	}
+}
+
+func TestFetchRecorder(t *testing.T) {
+	recorder := newFetchRecorder()
+	now := time.Date(2016, 1, 2, 10, 0, 0, 0, time.UTC)
+	recorder.record("feed", "tok", "Feedly/1.0 (10 subscribers)", false, now)
+	recorder.record("feed", "tok", "Feedly/1.0 (12 subscribers)", true, now)
+	recorder.record("feed", "other", "Feedly/1.0 (12 subscribers)", false, now)
+
+	counts := recorder.take()
+	if len(counts) != 2 {
+		t.Fatalf("expected fetches to be counted by token and user agent, got %v", counts)
+	}
+	key := fetchKey{feedID: "feed", day: "2016-01-02", token: hashFetchToken("tok"), userAgent: "Feedly/1.0 (N subscribers)"}
+	if c := counts[key]; c == nil || c.fetches != 2 || c.notModified != 1 || c.reportedSubscribers != 12 {
+		t.Errorf("unexpected counts %#v", c)
+	}
+	if len(recorder.take()) != 0 {
+		t.Error("expected the recorder to start over")
+	}
+}
+
+func TestEstimateSubscribers(t *testing.T) {
+	now := time.Date(2016, 1, 3, 1, 0, 0, 0, time.UTC)
+	days := []FetchDay{{Date: "2016-01-01", Subscribers: 50}, {Date: "2016-01-02", Subscribers: 30}, {Date: "2016-01-03", Subscribers: 2}}
+	if estimate := estimateSubscribers(days, now); estimate != 30 {
+		t.Errorf("expected estimate of 30, got %v", estimate)
+	}
+	if estimate := estimateSubscribers(nil, now); estimate != 0 {
+		t.Errorf("expected no subscribers, got %v", estimate)
+	}
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// addresses that urls given by users must not lead to: loopback, private,
+// shared, link-local, multicast and unspecified addresses.
+var nonPublicNets = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// allowLoopback lets the guarded transport connect to loopback addresses, for
+// the tests that run local servers.
+var allowLoopback = false
+
+var guardedDialer = &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+
+// guardedTransport is the transport of the clients that fetch urls given by
+// users. It only connects to public addresses, which are checked when
+// connecting so that redirects and dns answers cannot lead to internal
+// services either.
+var guardedTransport = &http.Transport{
+	Dial:                guardedDial,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for idx, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[idx] = ipNet
+	}
+	return nets
+}
+
+func isPublicIP(ip net.IP) bool {
+	if allowLoopback && ip.IsLoopback() {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, ipNet := range nonPublicNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsPublicHost tells whether a host only resolves to public addresses.
+func IsPublicHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// guardedDial connects to the first public address of a host, dialing the
+// address itself so that it cannot be resolved again to another one.
+func guardedDial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if isPublicIP(ip) {
+			return guardedDialer.Dial(network, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	return nil, fmt.Errorf("%v is not a public address", host)
+}
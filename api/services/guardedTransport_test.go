@@ -0,0 +1,37 @@
+package services
+
+import (
+	"net"
+	"testing"
+)
+
+// allowLocalServers lets the guarded transport reach httptest servers, until
+// the returned function is called.
+func allowLocalServers() func() {
+	allowLoopback = true
+	return func() { allowLoopback = false }
+}
+
+func TestIsPublicIP(t *testing.T) {
+	public := []string{"93.184.216.34", "8.8.8.8", "172.32.0.1", "2606:2800:220:1:248:1893:25c8:1946"}
+	for _, addr := range public {
+		if !isPublicIP(net.ParseIP(addr)) {
+			t.Errorf("expected %v to be public", addr)
+		}
+	}
+	private := []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1",
+		"0.0.0.0", "::", "::1", "fd00::1", "fe80::1", "::ffff:127.0.0.1", "::ffff:169.254.169.254"}
+	for _, addr := range private {
+		if isPublicIP(net.ParseIP(addr)) {
+			t.Errorf("expected %v not to be public", addr)
+		}
+	}
+}
+
+func TestIsPublicHost(t *testing.T) {
+	for _, host := range []string{"localhost", "127.0.0.1:6379", "[::1]:80", "169.254.169.254"} {
+		if IsPublicHost(host) {
+			t.Errorf("expected %v not to be public", host)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package services
+
+import (
+	"bytes"
+	"html"
+	"strings"
+)
+
+// a small, forgiving html tokenizer: good enough to pick metadata and text
+// out of real-world pages, which are rarely well-formed.
+
+type htmlTokenKind int
+
+const (
+	htmlText htmlTokenKind = iota
+	htmlStartTag
+	htmlEndTag
+	htmlComment
+)
+
+type htmlToken struct {
+	kind        htmlTokenKind
+	name        string // lowercased tag name
+	attrs       map[string]string
+	text        string // unescaped text, for text tokens
+	raw         string // source of the token
+	selfClosing bool
+}
+
+func (tok htmlToken) attr(name string) string {
+	return tok.attrs[name]
+}
+
+// elements whose content is not markup
+var htmlRawTextElements = map[string]bool{"script": true, "style": true, "textarea": true, "title": true}
+
+// tokenizeHTML calls fn with each token of src, until fn returns false.
+func tokenizeHTML(src string, fn func(tok htmlToken) bool) {
+	pos := 0
+	for pos < len(src) {
+		lt := strings.IndexByte(src[pos:], '<')
+		if lt < 0 {
+			fn(newHTMLText(src[pos:]))
+			return
+		}
+		if lt > 0 {
+			if !fn(newHTMLText(src[pos : pos+lt])) {
+				return
+			}
+			pos += lt
+		}
+
+		tok, end := parseHTMLMarkup(src, pos)
+		if end <= pos { // not markup: a lone '<'
+			if !fn(newHTMLText("<")) {
+				return
+			}
+			pos++
+			continue
+		}
+		if !fn(tok) {
+			return
+		}
+		pos = end
+
+		if tok.kind == htmlStartTag && !tok.selfClosing && htmlRawTextElements[tok.name] {
+			closing := indexFold(src[pos:], "</"+tok.name)
+			if closing < 0 {
+				closing = len(src) - pos
+			}
+			content := src[pos : pos+closing]
+			text := htmlToken{kind: htmlText, raw: content, text: content}
+			if tok.name == "title" || tok.name == "textarea" {
+				text.text = html.UnescapeString(content)
+			}
+			if closing > 0 && !fn(text) {
+				return
+			}
+			pos += closing
+		}
+	}
+}
+
+func newHTMLText(raw string) htmlToken {
+	return htmlToken{kind: htmlText, raw: raw, text: html.UnescapeString(raw)}
+}
+
+// parseHTMLMarkup parses the tag, comment or declaration starting at src[pos],
+// which is a '<'. It returns the position following it, or pos if there is
+// no markup there.
+func parseHTMLMarkup(src string, pos int) (htmlToken, int) {
+	rest := src[pos:]
+	switch {
+	case strings.HasPrefix(rest, "<!--"):
+		end := strings.Index(rest[4:], "-->")
+		if end < 0 {
+			return htmlToken{kind: htmlComment, raw: rest}, len(src)
+		}
+		return htmlToken{kind: htmlComment, raw: rest[:end+7]}, pos + end + 7
+	case strings.HasPrefix(rest, "<!") || strings.HasPrefix(rest, "<?"):
+		end := strings.IndexByte(rest, '>')
+		if end < 0 {
+			end = len(rest) - 1
+		}
+		return htmlToken{kind: htmlComment, raw: rest[:end+1]}, pos + end + 1
+	}
+
+	tok := htmlToken{kind: htmlStartTag}
+	i := 1
+	if i < len(rest) && rest[i] == '/' {
+		tok.kind = htmlEndTag
+		i++
+	}
+	nameStart := i
+	for i < len(rest) && isHTMLNameChar(rest[i]) {
+		i++
+	}
+	if i == nameStart {
+		return htmlToken{}, pos
+	}
+	tok.name = strings.ToLower(rest[nameStart:i])
+	tok.attrs = map[string]string{}
+
+	for i < len(rest) {
+		for i < len(rest) && isHTMLSpace(rest[i]) {
+			i++
+		}
+		if i >= len(rest) {
+			break
+		}
+		if rest[i] == '>' {
+			i++
+			tok.raw = rest[:i]
+			return tok, pos + i
+		}
+		if rest[i] == '/' {
+			tok.selfClosing = true
+			i++
+			continue
+		}
+
+		keyStart := i
+		for i < len(rest) && !isHTMLSpace(rest[i]) && rest[i] != '=' && rest[i] != '>' && rest[i] != '/' {
+			i++
+		}
+		key := strings.ToLower(rest[keyStart:i])
+		for i < len(rest) && isHTMLSpace(rest[i]) {
+			i++
+		}
+
+		value := ""
+		if i < len(rest) && rest[i] == '=' {
+			i++
+			for i < len(rest) && isHTMLSpace(rest[i]) {
+				i++
+			}
+			if i < len(rest) && (rest[i] == '"' || rest[i] == '\'') {
+				quote := rest[i]
+				end := strings.IndexByte(rest[i+1:], quote)
+				if end < 0 {
+					end = len(rest) - i - 1
+				}
+				value = rest[i+1 : i+1+end]
+				i += end + 2
+			} else {
+				valueStart := i
+				for i < len(rest) && !isHTMLSpace(rest[i]) && rest[i] != '>' {
+					i++
+				}
+				value = rest[valueStart:i]
+			}
+		}
+		if key != "" {
+			if _, exists := tok.attrs[key]; !exists {
+				tok.attrs[key] = html.UnescapeString(value)
+			}
+		}
+	}
+
+	// unterminated tag: take it all
+	tok.raw = rest
+	return tok, len(src)
+}
+
+func isHTMLNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == ':'
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// indexFold is a case-insensitive strings.Index, for ascii substrings.
+func indexFold(s, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// collapseSpaces trims s and replaces runs of whitespace with single spaces.
+func collapseSpaces(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// htmlNode is an element or a text node of a parsed html document.
+type htmlNode struct {
+	name     string // lowercased tag name, empty for text nodes
+	attrs    map[string]string
+	text     string
+	parent   *htmlNode
+	children []*htmlNode
+}
+
+func (n *htmlNode) attr(name string) string {
+	return n.attrs[name]
+}
+
+func (n *htmlNode) appendChild(child *htmlNode) {
+	child.parent = n
+	n.children = append(n.children, child)
+}
+
+// textContent returns the text of n and its descendants, with whitespace collapsed.
+func (n *htmlNode) textContent() string {
+	var buf bytes.Buffer
+	n.walk(func(node *htmlNode) bool {
+		if node.name == "" {
+			buf.WriteString(node.text)
+			buf.WriteByte(' ')
+		}
+		return !htmlRawTextElements[node.name] || node.name == "title"
+	})
+	return collapseSpaces(buf.String())
+}
+
+// walk calls fn with n and its descendants, depth first. The children of a
+// node are skipped when fn returns false for it.
+func (n *htmlNode) walk(fn func(node *htmlNode) bool) {
+	if !fn(n) {
+		return
+	}
+	for _, child := range n.children {
+		child.walk(fn)
+	}
+}
+
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// elements that are implicitly closed by an opening tag of the same name
+var htmlSelfNestingElements = map[string]bool{"p": true, "li": true, "dt": true, "dd": true, "tr": true, "td": true, "th": true, "option": true}
+
+// block elements that implicitly close an open paragraph
+var htmlBlockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "div": true, "dl": true, "fieldset": true,
+	"figure": true, "footer": true, "form": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "main": true, "nav": true, "ol": true, "p": true, "pre": true, "section": true, "table": true, "ul": true,
+}
+
+// parseHTMLTree builds the element tree of src. Like browsers, it recovers
+// from unclosed and stray tags rather than failing.
+func parseHTMLTree(src string) *htmlNode {
+	root := &htmlNode{name: "#document"}
+	current := root
+	tokenizeHTML(src, func(tok htmlToken) bool {
+		switch tok.kind {
+		case htmlText:
+			current.appendChild(&htmlNode{text: tok.text})
+		case htmlStartTag:
+			if current.name == "p" && htmlBlockElements[tok.name] ||
+				current.name == tok.name && htmlSelfNestingElements[tok.name] {
+				current = current.parent
+			}
+			node := &htmlNode{name: tok.name, attrs: tok.attrs}
+			current.appendChild(node)
+			if !tok.selfClosing && !htmlVoidElements[tok.name] {
+				current = node
+			}
+		case htmlEndTag:
+			for node := current; node != root; node = node.parent {
+				if node.name == tok.name {
+					current = node.parent
+					break
+				}
+			}
+		}
+		return true
+	})
+	return root
+}
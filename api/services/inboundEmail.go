@@ -0,0 +1,323 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+const inboundEmailMaxLinks = 50
+
+// InboundEmail is what is saved out of a message mailed to a feed.
+type InboundEmail struct {
+	Subject string
+	Links   []string
+}
+
+// startInboundEmail listens for mail sent to the feeds' secret addresses.
+func startInboundEmail(config Config, feeds *Feeds) error {
+	listener, err := net.Listen("tcp", config.SMTPAddr)
+	if err != nil {
+		return fmt.Errorf("unable to listen for smtp on %v: %v", config.SMTPAddr, err)
+	}
+	server := &smtpServer{
+		hostname:        config.InboundEmailDomain,
+		acceptRecipient: feeds.acceptsEmail,
+		deliver:         feeds.deliverEmail,
+	}
+	go func() {
+		log.Printf("receiving mail on %v for %v", config.SMTPAddr, config.InboundEmailDomain)
+		if err := server.serve(listener); err != nil {
+			log.Printf("smtp server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// GetEmailAddress returns the address that saves the links it receives to
+// the feed, or ErrNotFound if the feed doesn't have one.
+func (fs *Feeds) GetEmailAddress(user User, feedID RecordID) (string, error) {
+	if !fs.config.inboundEmailEnabled() {
+		return "", ErrEmailDisabled
+	}
+	var token sql.NullString
+	err := fs.db.QueryRow("SELECT email_token FROM feeds WHERE id=$1 AND owner_id=$2", feedID, user.ID).Scan(&token)
+	if err == sql.ErrNoRows || err == nil && !token.Valid {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return token.String + "@" + fs.config.InboundEmailDomain, nil
+}
+
+// ResetEmailAddress gives the feed a new secret address, replacing the
+// previous one if any.
+func (fs *Feeds) ResetEmailAddress(user User, feedID RecordID) (string, error) {
+	if !fs.config.inboundEmailEnabled() {
+		return "", ErrEmailDisabled
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("unable to generate email token: %v", err)
+	}
+	token := hex.EncodeToString(buf)
+
+	res, err := fs.db.Exec("UPDATE feeds SET email_token=$1 WHERE id=$2 AND owner_id=$3 AND query IS NULL", token, feedID, user.ID)
+	if err != nil {
+		return "", err
+	}
+	if err := checkRowsAffected(res, 1); err != nil {
+		return "", err
+	}
+	return token + "@" + fs.config.InboundEmailDomain, nil
+}
+
+func (fs *Feeds) DeleteEmailAddress(user User, feedID RecordID) error {
+	res, err := fs.db.Exec("UPDATE feeds SET email_token=NULL WHERE id=$1 AND owner_id=$2", feedID, user.ID)
+	if err != nil {
+		return err
+	}
+	return checkRowsAffected(res, 1)
+}
+
+// feedForEmail finds the feed whose secret address is recipient.
+func (fs *Feeds) feedForEmail(recipient string) (User, RecordID, error) {
+	at := strings.LastIndex(recipient, "@")
+	if at < 0 || !strings.EqualFold(recipient[at+1:], fs.config.InboundEmailDomain) {
+		return User{}, "", ErrNotFound
+	}
+	var user User
+	var feedID RecordID
+	err := fs.db.QueryRow("SELECT owner_id, id FROM feeds WHERE email_token=$1 AND query IS NULL",
+		strings.ToLower(recipient[:at])).Scan(&user.ID, &feedID)
+	if err == sql.ErrNoRows {
+		return User{}, "", ErrNotFound
+	} else if err != nil {
+		return User{}, "", err
+	}
+	return user, feedID, nil
+}
+
+func (fs *Feeds) acceptsEmail(recipient string) bool {
+	_, _, err := fs.feedForEmail(recipient)
+	if err != nil && err != ErrNotFound {
+		log.Printf("unable to look up recipient %v: %v", recipient, err)
+	}
+	return err == nil
+}
+
+func (fs *Feeds) deliverEmail(recipients []string, data []byte) error {
+	email, err := parseInboundEmail(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	for _, recipient := range recipients {
+		user, feedID, err := fs.feedForEmail(recipient)
+		if err != nil {
+			return err
+		}
+		err = addEmailLinks(email, feedID, func(item *FeedItem) error {
+			return fs.AddItem(user, item)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addEmailLinks adds the links of a message as items of a feed. Links the
+// feed already has are skipped, since newsletters often repeat some of them.
+func addEmailLinks(email InboundEmail, feedID RecordID, addItem func(item *FeedItem) error) error {
+	for _, link := range email.Links {
+		item := FeedItem{FeedID: feedID, Link: link}
+		if len(email.Links) == 1 {
+			item.Title = email.Subject
+		}
+		if err := addItem(&item); err != nil && err != ErrDuplicateItem {
+			return fmt.Errorf("unable to add %v to feed %v: %v", link, feedID, err)
+		}
+	}
+	return nil
+}
+
+var (
+	emailLinkRegexp          = regexp.MustCompile(`https?://[^\s<>"'()\[\]{}]+`)
+	emailEncodedWordRegexp   = regexp.MustCompile(`=\?([^?]+)\?([bBqQ])\?([^?]*)\?=`)
+	emailEncodedWordsSpacing = regexp.MustCompile(`(\?=)\s+(=\?)`)
+	emailSubjectPrefixRegexp = regexp.MustCompile(`(?i)^((re|fwd?|tr)\s*:\s*)+`)
+)
+
+// parseInboundEmail extracts the subject and the links of a message. When a
+// message has both an html and a text version, the links of the html version
+// are used.
+func parseInboundEmail(r io.Reader) (InboundEmail, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return InboundEmail{}, fmt.Errorf("invalid message: %v", err)
+	}
+
+	subject := decodeEmailHeader(msg.Header.Get("Subject"))
+	email := InboundEmail{Subject: collapseSpaces(emailSubjectPrefixRegexp.ReplaceAllString(subject, ""))}
+
+	var htmlLinks, textLinks []string
+	err = walkEmailParts(textproto.MIMEHeader(msg.Header), msg.Body, 0, func(mediaType string, body []byte) {
+		switch mediaType {
+		case "text/html":
+			htmlLinks = append(htmlLinks, htmlLinksOf(string(body))...)
+		case "text/plain":
+			textLinks = append(textLinks, emailLinkRegexp.FindAllString(string(body), -1)...)
+		}
+	})
+	if err != nil {
+		return InboundEmail{}, err
+	}
+
+	links := htmlLinks
+	if len(links) == 0 {
+		links = textLinks
+	}
+	seen := map[string]bool{}
+	for _, link := range links {
+		link = strings.TrimRight(link, ".,;:!?")
+		if seen[link] || strings.Contains(strings.ToLower(link), "unsubscribe") {
+			continue
+		}
+		seen[link] = true
+		email.Links = append(email.Links, link)
+		if len(email.Links) == inboundEmailMaxLinks {
+			break
+		}
+	}
+	return email, nil
+}
+
+// walkEmailParts calls fn with the decoded body of every leaf part of a message.
+func walkEmailParts(header textproto.MIMEHeader, body io.Reader, depth int, fn func(mediaType string, body []byte)) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth > 10 {
+			return fmt.Errorf("too many nested parts")
+		}
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("invalid multipart message: %v", err)
+			}
+			if err := walkEmailParts(part.Header, part, depth+1, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("unable to read message part: %v", err)
+	}
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		data, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+		if err != nil {
+			return fmt.Errorf("invalid base64 part: %v", err)
+		}
+	case "quoted-printable":
+		data = decodeQuotedPrintable(data)
+	}
+	fn(mediaType, data)
+	return nil
+}
+
+func htmlLinksOf(src string) []string {
+	links := []string{}
+	tokenizeHTML(src, func(tok htmlToken) bool {
+		if tok.kind == htmlStartTag && tok.name == "a" {
+			if link := resolveLink(nil, strings.TrimSpace(tok.attr("href"))); link != "" {
+				links = append(links, link)
+			}
+		}
+		return true
+	})
+	return links
+}
+
+// decodeQuotedPrintable decodes the quoted-printable encoding of rfc 2045,
+// leaving malformed escapes as they are.
+func decodeQuotedPrintable(data []byte) []byte {
+	var buf bytes.Buffer
+	for idx := 0; idx < len(data); idx++ {
+		c := data[idx]
+		if c != '=' {
+			buf.WriteByte(c)
+			continue
+		}
+		rest := data[idx+1:]
+		switch {
+		case bytes.HasPrefix(rest, []byte("\r\n")):
+			idx += 2
+		case bytes.HasPrefix(rest, []byte("\n")):
+			idx++
+		case len(rest) >= 2 && isHexDigit(rest[0]) && isHexDigit(rest[1]):
+			decoded, _ := hex.DecodeString(string(rest[:2]))
+			buf.Write(decoded)
+			idx += 2
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.Bytes()
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// decodeEmailHeader decodes the encoded words of rfc 2047, such as
+// "=?utf-8?q?caf=C3=A9?=".
+func decodeEmailHeader(value string) string {
+	value = emailEncodedWordsSpacing.ReplaceAllString(value, "$1$2")
+	return emailEncodedWordRegexp.ReplaceAllStringFunc(value, func(word string) string {
+		parts := emailEncodedWordRegexp.FindStringSubmatch(word)
+		charset, encoding, text := strings.ToLower(parts[1]), strings.ToLower(parts[2]), parts[3]
+
+		var data []byte
+		if encoding == "b" {
+			var err error
+			if data, err = base64.StdEncoding.DecodeString(text); err != nil {
+				return word
+			}
+		} else {
+			data = decodeQuotedPrintable([]byte(strings.Replace(text, "_", " ", -1)))
+		}
+
+		if charset == "utf-8" || charset == "utf8" {
+			return string(data)
+		}
+		reader, err := latin1CharsetReader(charset, bytes.NewReader(data))
+		if err != nil {
+			return word
+		}
+		decoded, _ := ioutil.ReadAll(reader)
+		return string(decoded)
+	})
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"bufio"
+	"net"
+	"net/smtp"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testNewsletter = "From: news@example.com\r\n" +
+	"To: feed@example.org\r\n" +
+	"Subject: Fwd: =?utf-8?q?Caf=C3=A9?= =?utf-8?b?IG5ld3M=?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"sep\"\r\n" +
+	"\r\n" +
+	"--sep\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Read https://example.com/text-only.\r\n" +
+	"--sep\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"<p><a href=3D\"https://example.com/a?x=3D1\">A</a> <a href=3D\"mailto:x@example.com\">mail</a>=\r\n" +
+	" <a href=3D\"https://example.com/b\">B</a> <a href=3D\"https://example.com/a?x=3D1\">A again</a>=\r\n" +
+	" <a href=3D\"https://example.com/unsubscribe\">stop</a></p>\r\n" +
+	"--sep--\r\n"
+
+func TestParseInboundEmail(t *testing.T) {
+	email, err := parseInboundEmail(strings.NewReader(testNewsletter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email.Subject != "Café news" {
+		t.Errorf("unexpected subject %q", email.Subject)
+	}
+	expected := []string{"https://example.com/a?x=1", "https://example.com/b"}
+	if !reflect.DeepEqual(email.Links, expected) {
+		t.Errorf("expected links %v, got %v", expected, email.Links)
+	}
+}
+
+func TestParseInboundEmailText(t *testing.T) {
+	email, err := parseInboundEmail(strings.NewReader("Subject: look\r\n\r\nsee (https://example.com/x), and https://example.com/y.\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"https://example.com/x", "https://example.com/y"}
+	if email.Subject != "look" || !reflect.DeepEqual(email.Links, expected) {
+		t.Errorf("unexpected email %#v", email)
+	}
+}
+
+func TestAddEmailLinksSkipsDuplicates(t *testing.T) {
+	email := InboundEmail{Subject: "News", Links: []string{"https://example.com/", "https://example.com/a", "https://example.com/b"}}
+	added := []string{}
+	err := addEmailLinks(email, "feed", func(item *FeedItem) error {
+		if item.Link == "https://example.com/" {
+			return ErrDuplicateItem
+		}
+		added = append(added, item.Link)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"https://example.com/a", "https://example.com/b"}; !reflect.DeepEqual(added, expected) {
+		t.Errorf("expected %v to be added, got %v", expected, added)
+	}
+}
+
+func TestSmtpServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	delivered := make(chan []string, 1)
+	server := &smtpServer{
+		hostname:        "example.org",
+		acceptRecipient: func(recipient string) bool { return recipient == "feed@example.org" },
+		deliver: func(recipients []string, data []byte) error {
+			email, err := parseInboundEmail(strings.NewReader(string(data)))
+			if err != nil {
+				return err
+			}
+			delivered <- append(recipients, email.Links...)
+			return nil
+		},
+	}
+	go server.serve(listener)
+
+	client, err := smtp.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Mail("news@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt("nobody@example.org"); err == nil {
+		t.Error("expected unknown recipient to be rejected")
+	}
+	if err := client.Rcpt("feed@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(testNewsletter)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"feed@example.org", "https://example.com/a?x=1", "https://example.com/b"}
+	if actual := <-delivered; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected delivery %v, got %v", expected, actual)
+	}
+}
+
+func TestSmtpServerDropsLongLines(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	server := &smtpServer{hostname: "example.org"}
+	go server.serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	greeting := bufio.NewReader(conn)
+	if _, err := greeting.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(strings.Repeat("x", 2*smtpMaxLineLength)))
+	if line, err := greeting.ReadString('\n'); err != nil || !strings.HasPrefix(line, "500 ") {
+		t.Errorf("expected line to be rejected, got %q, %v", line, err)
+	}
+	if line, err := greeting.ReadString('\n'); err == nil {
+		t.Errorf("expected connection to be dropped, got %q", line)
+	}
+}
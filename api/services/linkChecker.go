@@ -0,0 +1,260 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// states of the link of an item, as found by the link checker
+const (
+	LinkOK         = "ok"
+	LinkRedirected = "redirected" // the link permanently redirects elsewhere
+	LinkBroken     = "broken"
+)
+
+const (
+	linkChecksInterval      = time.Minute
+	linkChecksBatchSize     = 50
+	linkRecheckInterval     = 7 * 24 * time.Hour
+	linkRetryInterval       = 24 * time.Hour
+	linkBrokenAfterFailures = 2 // so that a server being briefly down doesn't hide items
+	linkMaxRedirects        = 10
+)
+
+var errLinkRedirect = errors.New("redirect")
+
+// linkClient doesn't follow redirects, so that their status can be checked
+var linkClient = &http.Client{
+	Transport: guardedTransport,
+	Timeout:   15 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return errLinkRedirect
+	},
+}
+
+// FeedHealth sums up the state of the links of the items of a feed.
+type FeedHealth struct {
+	FeedID     RecordID     `json:"feedID"`
+	OK         int          `json:"ok"`
+	Redirected int          `json:"redirected"`
+	Broken     int          `json:"broken"`
+	Unchecked  int          `json:"unchecked"`
+	Items      []ItemHealth `json:"items"`
+}
+
+// ItemHealth is the result of the last check of the link of an item. State is
+// empty until the link is checked.
+type ItemHealth struct {
+	ID          RecordID   `json:"id"`
+	Link        string     `json:"link"`
+	Title       string     `json:"title"`
+	State       string     `json:"state"`
+	Status      int        `json:"status"`
+	FinalURL    string     `json:"finalURL"`
+	Error       string     `json:"error,omitempty"`
+	Failures    int        `json:"failures"`
+	LastChecked *time.Time `json:"lastChecked"`
+}
+
+func (fs *Feeds) GetHealth(user User, feedID RecordID) (FeedHealth, error) {
+	var exists bool
+	err := fs.db.QueryRow("SELECT true FROM feeds WHERE id=$1 AND owner_id=$2", feedID, user.ID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return FeedHealth{}, ErrNotFound
+	} else if err != nil {
+		return FeedHealth{}, err
+	}
+
+	rows, err := fs.db.Query(`SELECT id, link, title, coalesce(link_state, ''), coalesce(link_status, 0),
+			coalesce(link_final_url, ''), coalesce(link_error, ''), link_failures, link_checked
+		FROM feed_entries($1, NULL) ORDER BY date_added`, feedID)
+	if err != nil {
+		return FeedHealth{}, fmt.Errorf("unable to query item links of feed %v: %v", feedID, err)
+	}
+	defer rows.Close()
+
+	health := FeedHealth{FeedID: feedID, Items: []ItemHealth{}}
+	for rows.Next() {
+		var item ItemHealth
+		var lastChecked pq.NullTime
+		err := rows.Scan(&item.ID, &item.Link, &item.Title, &item.State, &item.Status, &item.FinalURL, &item.Error,
+			&item.Failures, &lastChecked)
+		if err != nil {
+			return FeedHealth{}, err
+		}
+		if lastChecked.Valid {
+			item.LastChecked = &lastChecked.Time
+		}
+		switch item.State {
+		case LinkOK:
+			health.OK++
+		case LinkRedirected:
+			health.Redirected++
+		case LinkBroken:
+			health.Broken++
+		default:
+			health.Unchecked++
+		}
+		health.Items = append(health.Items, item)
+	}
+	return health, rows.Err()
+}
+
+// checkedItem is an item whose link is due for a check, along with the state
+// of the previous check
+type checkedItem struct {
+	id       RecordID
+	feedID   RecordID
+	ownerID  RecordID
+	link     string
+	state    string
+	failures int
+}
+
+func (fs *Feeds) startLinkChecksLoop(interval time.Duration) {
+	go func() {
+		tick := time.Tick(interval)
+		for range tick {
+			if err := fs.checkDueLinks(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+func (fs *Feeds) checkDueLinks() error {
+	// the due items are claimed by pushing back their next check
+	rows, err := fs.db.Query(`UPDATE feed_items SET link_next_check = NOW() + $1 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM feed_items WHERE link_next_check <= NOW() ORDER BY link_next_check LIMIT $2 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, feed_id, owner_id, link, coalesce(link_state, ''), link_failures`,
+		linkRetryInterval.Seconds(), linkChecksBatchSize)
+	if err != nil {
+		return fmt.Errorf("unable to query due item links: %v", err)
+	}
+
+	items := []checkedItem{}
+	for rows.Next() {
+		var item checkedItem
+		if err := rows.Scan(&item.id, &item.feedID, &item.ownerID, &item.link, &item.state, &item.failures); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	processClaimedRows(len(items), func(idx int) {
+		fs.checkItemLink(items[idx])
+	})
+	return nil
+}
+
+func (fs *Feeds) checkItemLink(item checkedItem) {
+	check := checkLink(item.link)
+	state, failures, nextCheck := item.state, 0, linkRecheckInterval
+	if check.failed() {
+		failures = item.failures + 1
+		nextCheck = linkRetryInterval
+		if failures >= linkBrokenAfterFailures {
+			state = LinkBroken
+		}
+	} else if check.permanentRedirect {
+		state = LinkRedirected
+	} else {
+		state = LinkOK
+	}
+
+	var errText string
+	if check.err != nil {
+		errText = check.err.Error()
+	}
+	_, err := fs.db.Exec(`UPDATE feed_items SET link_state=NULLIF($1, ''), link_status=NULLIF($2, 0),
+			link_final_url=NULLIF($3, ''), link_error=NULLIF($4, ''), link_failures=$5, link_checked=NOW(),
+			link_next_check = NOW() + $6 * interval '1 second'
+		WHERE id=$7`,
+		state, check.status, check.finalURL, errText, failures, nextCheck.Seconds(), item.id)
+	if err != nil {
+		log.Printf("unable to save link check of item %v: %v", item.id, err)
+		return
+	}
+	if state != item.state {
+		fs.invalidateFeedCache(feedCacheHint{User{ID: item.ownerID}, item.feedID})
+	}
+}
+
+// linkCheck is the outcome of requesting a link and following its redirects
+type linkCheck struct {
+	status            int // status of the final response, 0 if there was none
+	finalURL          string
+	permanentRedirect bool // whether the link itself permanently redirects
+	err               error
+}
+
+func (check linkCheck) failed() bool {
+	return check.err != nil || check.status < 200 || check.status >= 400
+}
+
+func checkLink(link string) linkCheck {
+	check := linkCheck{finalURL: link}
+	for hops := 0; hops <= linkMaxRedirects; hops++ {
+		resp, err := requestLink(check.finalURL)
+		if err != nil {
+			check.status, check.err = 0, err
+			return check
+		}
+		check.status = resp.StatusCode
+		if resp.StatusCode < 300 || resp.StatusCode >= 400 || resp.StatusCode == http.StatusNotModified {
+			return check
+		}
+
+		location, err := resp.Location()
+		if err != nil {
+			check.err = fmt.Errorf("redirect with no valid location: %v", err)
+			return check
+		}
+		if hops == 0 {
+			check.permanentRedirect = resp.StatusCode == http.StatusMovedPermanently || resp.StatusCode == 308
+		}
+		check.finalURL = location.String()
+	}
+	check.err = fmt.Errorf("stopped after %v redirects", linkMaxRedirects)
+	return check
+}
+
+// requestLink sends a HEAD request, falling back to GET for the servers that
+// don't handle HEAD. The body of the response is never read.
+func requestLink(link string) (*http.Response, error) {
+	resp, err := doLinkRequest("HEAD", link)
+	if err == nil && resp.StatusCode < 400 {
+		return resp, nil
+	}
+	return doLinkRequest("GET", link)
+}
+
+func doLinkRequest(method, link string) (*http.Response, error) {
+	req, err := http.NewRequest(method, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := linkClient.Do(req)
+	if urlErr, ok := err.(*url.Error); ok && urlErr.Err == errLinkRedirect && resp != nil {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
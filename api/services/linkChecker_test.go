@@ -0,0 +1,61 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckLink(t *testing.T) {
+	defer allowLocalServers()()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/temporary", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/temporary", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusFound)
+	})
+	mux.HandleFunc("/no-head", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		path              string
+		status            int
+		finalPath         string
+		permanentRedirect bool
+		failed            bool
+	}{
+		{"/ok", 200, "/ok", false, false},
+		{"/moved", 200, "/ok", true, false},
+		{"/temporary", 200, "/ok", false, false},
+		{"/no-head", 200, "/no-head", false, false},
+		{"/missing", 404, "/missing", false, true},
+		{"/loop", 302, "/loop", false, true},
+	}
+	for _, test := range tests {
+		check := checkLink(server.URL + test.path)
+		if check.status != test.status || check.finalURL != server.URL+test.finalPath ||
+			check.permanentRedirect != test.permanentRedirect || check.failed() != test.failed {
+			t.Errorf("%v: unexpected check %#v", test.path, check)
+		}
+	}
+}
+
+func TestCheckLinkNonPublic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	check := checkLink(server.URL + "/ok")
+	if check.status != 0 || check.err == nil || !check.failed() {
+		t.Errorf("expected loopback link to be unreachable, got %#v", check)
+	}
+}
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"net/url"
+	"strings"
+)
+
+// query parameters that only serve to track where visitors come from
+var trackingParams = map[string]bool{"fbclid": true, "gclid": true, "dclid": true, "msclkid": true, "mc_cid": true, "mc_eid": true}
+
+// normalizeLink returns the canonical form of a web link, used to tell
+// whether two links are the same page: the scheme and host are lowercased,
+// internationalized hosts are punycode-encoded, default ports, fragments and
+// tracking parameters are removed. Links that are not http(s) urls are
+// returned as is.
+func normalizeLink(link string) string {
+	link = strings.TrimSpace(link)
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return link
+	}
+
+	host, port := u.Host, ""
+	if idx := strings.LastIndex(host, ":"); idx > strings.LastIndex(host, "]") {
+		host, port = host[:idx], host[idx+1:]
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if port == "80" && u.Scheme == "http" || port == "443" && u.Scheme == "https" {
+		port = ""
+	}
+	u.Host = asciiHost(host)
+	if port != "" {
+		u.Host += ":" + port
+	}
+
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.Fragment = ""
+	u.RawQuery = stripTrackingParams(u.RawQuery)
+	return u.String()
+}
+
+func stripTrackingParams(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	kept := []string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name := strings.SplitN(param, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "utm_") || trackingParams[name] {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&")
+}
+
+// asciiHost encodes the non-ascii labels of host with punycode, as described
+// by rfc 3490.
+func asciiHost(host string) string {
+	labels := strings.Split(host, ".")
+	for idx, label := range labels {
+		for _, r := range label {
+			if r >= 0x80 {
+				labels[idx] = "xn--" + punycodeEncode(label)
+				break
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+const (
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+)
+
+// punycodeEncode implements the encoding of rfc 3492.
+func punycodeEncode(label string) string {
+	runes := []rune(label)
+	out := []byte{}
+	for _, r := range runes {
+		if r < 0x80 {
+			out = append(out, byte(r))
+		}
+	}
+	basicCount := len(out)
+	handled := basicCount
+	if basicCount > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := punycodeInitialN, 0, punycodeInitialBias
+	for handled < len(runes) {
+		next := int(^uint(0) >> 1)
+		for _, r := range runes {
+			if int(r) >= n && int(r) < next {
+				next = int(r)
+			}
+		}
+		delta += (next - n) * (handled + 1)
+		n = next
+
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punycodeBase; ; k += punycodeBase {
+				t := k - bias
+				if t < punycodeTMin {
+					t = punycodeTMin
+				} else if t > punycodeTMax {
+					t = punycodeTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punycodeDigit(t+(q-t)%(punycodeBase-t)))
+				q = (q - t) / (punycodeBase - t)
+			}
+			out = append(out, punycodeDigit(q))
+			bias = punycodeAdapt(delta, handled+1, handled == basicCount)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func punycodeAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punycodeBase-punycodeTMin)*punycodeTMax)/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
@@ -0,0 +1,20 @@
+package services
+
+import "testing"
+
+func TestNormalizeLink(t *testing.T) {
+	tests := map[string]string{
+		"HTTP://Example.COM":                                      "http://example.com/",
+		"https://example.com:443/a#section":                       "https://example.com/a",
+		"http://example.com:8080/a":                               "http://example.com:8080/a",
+		"https://example.com/a?utm_source=x&id=1&fbclid=y&UTM_x=": "https://example.com/a?id=1",
+		"https://www.bücher.de/":                                  "https://www.xn--bcher-kva.de/",
+		"https://münchen.de./path":                                "https://xn--mnchen-3ya.de/path",
+		"mailto:someone@example.com":                              "mailto:someone@example.com",
+	}
+	for link, expected := range tests {
+		if actual := normalizeLink(link); actual != expected {
+			t.Errorf("normalizeLink(%q): expected %q, got %q", link, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	pageMaxSize     = 2 << 20
+	enrichWorkers   = 4
+	enrichQueueSize = 10000
+)
+
+var pageClient = &http.Client{Timeout: 15 * time.Second, Transport: guardedTransport}
+
+// PageMetadata is what describes a web page, from its <title> and its
+// OpenGraph and Twitter card tags.
+type PageMetadata struct {
+	Title        string
+	Description  string
+	CanonicalURL string
+	SiteName     string
+}
+
+type fetchedPage struct {
+	url  *url.URL // final url, after redirects
+	html string
+}
+
+// fetchPage gets the html of a page. The final url of the page is set as
+// soon as there is a response, even if it's not an html page.
+func fetchPage(link string) (fetchedPage, error) {
+	resp, err := pageClient.Get(link)
+	if err != nil {
+		return fetchedPage{}, fmt.Errorf("unable to fetch page %v: %v", link, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fetchedPage{}, fmt.Errorf("fetching page %v returned %v status", link, resp.StatusCode)
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return fetchedPage{url: resp.Request.URL}, fmt.Errorf("page %v is not html but %v", link, mediaType)
+	}
+
+	var body io.Reader = io.LimitReader(resp.Body, pageMaxSize)
+	if charset := strings.ToLower(params["charset"]); charset != "" && charset != "utf-8" && charset != "utf8" {
+		if body, err = latin1CharsetReader(charset, body); err != nil {
+			return fetchedPage{}, fmt.Errorf("unable to decode page %v: %v", link, err)
+		}
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return fetchedPage{}, fmt.Errorf("unable to read page %v: %v", link, err)
+	}
+	return fetchedPage{url: resp.Request.URL, html: string(data)}, nil
+}
+
+// extractPageMetadata picks the metadata out of the head of a page. OpenGraph
+// tags take precedence over Twitter card tags, which take precedence over
+// plain html ones.
+func extractPageMetadata(page fetchedPage) PageMetadata {
+	var title, meta = "", map[string]string{}
+	var canonical string
+	inTitle := false
+
+	tokenizeHTML(page.html, func(tok htmlToken) bool {
+		switch tok.kind {
+		case htmlStartTag:
+			switch tok.name {
+			case "title":
+				inTitle = title == ""
+			case "meta":
+				key := strings.ToLower(tok.attr("property"))
+				if key == "" {
+					key = strings.ToLower(tok.attr("name"))
+				}
+				if _, exists := meta[key]; key != "" && !exists {
+					meta[key] = collapseSpaces(tok.attr("content"))
+				}
+			case "link":
+				if canonical == "" && hasHTMLToken(tok.attr("rel"), "canonical") {
+					canonical = strings.TrimSpace(tok.attr("href"))
+				}
+			case "body":
+				return false
+			}
+		case htmlText:
+			if inTitle {
+				title = collapseSpaces(tok.text)
+				inTitle = false
+			}
+		case htmlEndTag:
+			return tok.name != "head"
+		}
+		return true
+	})
+
+	metadata := PageMetadata{
+		Title:       firstNonEmpty(meta["og:title"], meta["twitter:title"], title),
+		Description: firstNonEmpty(meta["og:description"], meta["twitter:description"], meta["description"]),
+		SiteName:    firstNonEmpty(meta["og:site_name"], meta["application-name"]),
+	}
+	if link := resolveLink(page.url, firstNonEmpty(canonical, meta["og:url"])); link != "" {
+		metadata.CanonicalURL = link
+	}
+	return metadata
+}
+
+// hasHTMLToken tells whether a space-separated attribute, such as rel, contains token.
+func hasHTMLToken(attr, token string) bool {
+	for _, t := range strings.Fields(attr) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveLink(base *url.URL, link string) string {
+	if link == "" {
+		return ""
+	}
+	ref, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	if base != nil {
+		ref = base.ResolveReference(ref)
+	}
+	if ref.Scheme != "http" && ref.Scheme != "https" {
+		return ""
+	}
+	return ref.String()
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// enrichItemsLater queues the given items, all from the same feed, so that
+// their pages get fetched in the background. Links that redirect are resolved
+// to their final url, items saved with only a link are filled in with their
+// page's metadata, the article content is extracted unless the feed has full
+// text turned off, and a snapshot of the page is stored if the feed keeps
+// them. When the queue is full, the items are left as they are.
+func (fs *Feeds) enrichItemsLater(user User, items []FeedItem) {
+	for idx, item := range items {
+		select {
+		case fs.enrichQueue <- enrichJob{user: user, item: item}:
+		default:
+			log.Printf("enrich queue is full, leaving %v items of feed %v as they are", len(items)-idx, item.FeedID)
+			return
+		}
+	}
+}
+
+type enrichJob struct {
+	user User
+	item FeedItem
+}
+
+// startEnrichWorkers starts the workers that fetch the pages of queued items,
+// so that bulk imports don't fetch thousands of pages at once.
+func (fs *Feeds) startEnrichWorkers(workers int) {
+	for idx := 0; idx < workers; idx++ {
+		go func() {
+			for job := range fs.enrichQueue {
+				opts, err := fs.enrichOptions(job.user, job.item.FeedID)
+				if err == nil {
+					err = fs.enrichItem(job.user, job.item, opts)
+				}
+				if err != nil {
+					log.Printf("unable to enrich item %v: %v", job.item.ID, err)
+				}
+			}
+		}()
+	}
+}
+
+// itemEnrichment is what, besides the metadata, is taken from the pages of
+// the items of a feed
+type itemEnrichment struct {
+	fullText bool
+	snapshot bool
+}
+
+func (fs *Feeds) enrichOptions(user User, feedID RecordID) (itemEnrichment, error) {
+	var noFullText, snapshots bool
+	err := fs.db.QueryRow("SELECT no_full_text, snapshots FROM feeds WHERE id=$1 AND owner_id=$2", feedID, user.ID).
+		Scan(&noFullText, &snapshots)
+	if err != nil {
+		return itemEnrichment{}, fmt.Errorf("unable to read feed %v: %v", feedID, err)
+	}
+	return itemEnrichment{fullText: !noFullText, snapshot: snapshots && fs.snapshots != nil}, nil
+}
+
+func (fs *Feeds) enrichItem(user User, item FeedItem, opts itemEnrichment) error {
+	page, err := fetchPage(item.Link)
+	if page.url != nil {
+		merged, err := fs.resolveItemLink(user, item, page.url.String())
+		if err != nil || merged {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	var metadata PageMetadata
+	if item.needsMetadata {
+		metadata = extractPageMetadata(page)
+	}
+	var content string
+	if opts.fullText {
+		content = extractArticle(page)
+	}
+
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the title is only replaced if it's still the link placeholder, in
+	// case the item was edited in the meantime
+	err = tx.QueryRow(`UPDATE feed_items SET
+			title=CASE WHEN title=link AND $1 != '' THEN $1 ELSE title END,
+			description=COALESCE(NULLIF(description, ''), NULLIF($2, '')),
+			canonical_url=COALESCE(NULLIF($3, ''), canonical_url),
+			site_name=COALESCE(NULLIF($4, ''), site_name),
+			content_html=COALESCE(NULLIF($5, ''), content_html),
+			date_modified=NOW()
+		WHERE id=$6 AND owner_id=$7
+		RETURNING title, coalesce(description, ''), coalesce(canonical_url, ''), coalesce(site_name, ''), coalesce(content_html, '')`,
+		metadata.Title, metadata.Description, metadata.CanonicalURL, metadata.SiteName, content, item.ID, user.ID).
+		Scan(&item.Title, &item.Description, &item.CanonicalURL, &item.SiteName, &item.ContentHTML)
+	if err == sql.ErrNoRows {
+		return nil // deleted in the meantime
+	} else if err != nil {
+		return fmt.Errorf("unable to save metadata of item %v: %v", item.ID, err)
+	}
+	ev, err := fs.emitEvent(tx, user, item.FeedID, EventItemUpdated, item)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fs.publishEvent(ev)
+	if opts.snapshot {
+		if err := fs.saveSnapshot(user, item, page); err != nil {
+			log.Printf("unable to take snapshot of item %v: %v", item.ID, err)
+		}
+	}
+
+	return fs.invalidateFeedCache(feedCacheHint{user, item.FeedID})
+}
+
+// resolveItemLink records the normalized url the link of an item redirects
+// to. If another item of the feed already has this link, the item is a
+// duplicate and is merged into it: its tags are moved to the other item, and
+// it is deleted.
+func (fs *Feeds) resolveItemLink(user User, item FeedItem, finalLink string) (bool, error) {
+	normalized := normalizeLink(finalLink)
+	if normalized == item.Link {
+		return false, nil
+	}
+
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var existingID RecordID
+	err = tx.QueryRow(`SELECT id FROM feed_items
+		WHERE feed_id=$1 AND owner_id=$2 AND id != $3 AND (normalized_link=$4 OR link=$4)
+		ORDER BY date_added LIMIT 1`,
+		item.FeedID, user.ID, item.ID, normalized).Scan(&existingID)
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec("UPDATE feed_items SET normalized_link=$1 WHERE id=$2 AND owner_id=$3", normalized, item.ID, user.ID)
+		if err != nil {
+			return false, fmt.Errorf("unable to save resolved link of item %v: %v", item.ID, err)
+		}
+		return false, tx.Commit()
+	} else if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO feed_item_tags(item_id, owner_id, tag)
+		SELECT $1, owner_id, tag FROM feed_item_tags moved WHERE item_id=$2 AND owner_id=$3
+			AND NOT EXISTS (SELECT 1 FROM feed_item_tags WHERE item_id=$1 AND tag=moved.tag)`,
+		existingID, item.ID, user.ID)
+	if err != nil {
+		return false, fmt.Errorf("unable to move tags of item %v to %v: %v", item.ID, existingID, err)
+	}
+	_, err = tx.Exec("DELETE FROM feed_items WHERE id=$1 AND owner_id=$2", item.ID, user.ID)
+	if err != nil {
+		return false, fmt.Errorf("unable to delete duplicate item %v: %v", item.ID, err)
+	}
+	ev, err := fs.emitEvent(tx, user, item.FeedID, EventItemDeleted, deletedItem{item.ID, item.FeedID})
+	if err != nil {
+		return false, err
+	}
+	fs.invalidateFeedCache(feedCacheHint{user, item.FeedID})
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	fs.publishEvent(ev)
+	return true, nil
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testPage = `<!DOCTYPE html>
+<html><head>
+  <title>
+    Plain   title
+  </title>
+  <meta name="description" content="plain description">
+  <meta property="og:title" content="Open &amp; Graph title">
+  <meta name="twitter:title" content="Twitter title">
+  <meta name="twitter:description" content="twitter description">
+  <meta property="og:site_name" content="Example">
+  <link rel="stylesheet canonical" href="/articles/1">
+  <script>var s = "<meta property='og:description' content='nope'>";</script>
+</head>
+<body><meta property="og:description" content="not in head"></body></html>`
+
+func TestExtractPageMetadata(t *testing.T) {
+	defer allowLocalServers()()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/page", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, testPage)
+	}))
+	defer server.Close()
+
+	page, err := fetchPage(server.URL + "/redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := extractPageMetadata(page)
+	expected := PageMetadata{
+		Title:        "Open & Graph title",
+		Description:  "twitter description",
+		CanonicalURL: server.URL + "/articles/1",
+		SiteName:     "Example",
+	}
+	if metadata != expected {
+		t.Errorf("expected %+v, got %+v", expected, metadata)
+	}
+}
+
+func TestExtractPageMetadataFallbacks(t *testing.T) {
+	page := fetchedPage{html: `<html><HEAD><Title>Only &lt;title&gt;</Title><meta name="description" content=" some  text "></HEAD>`}
+	metadata := extractPageMetadata(page)
+	if metadata.Title != "Only <title>" || metadata.Description != "some text" || metadata.CanonicalURL != "" {
+		t.Errorf("unexpected metadata %+v", metadata)
+	}
+}
+
+func TestFetchPageRejectsNonHTML(t *testing.T) {
+	defer allowLocalServers()()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		fmt.Fprint(w, "%PDF-1.4")
+	}))
+	defer server.Close()
+
+	if _, err := fetchPage(server.URL); err == nil {
+		t.Error("expected an error for a non-html page")
+	}
+}
+
+func TestFetchPageRefusesLocalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, testPage)
+	}))
+	defer server.Close()
+
+	if _, err := fetchPage(server.URL); err == nil {
+		t.Error("expected a page on a local address to be refused")
+	}
+}
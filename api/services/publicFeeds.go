@@ -0,0 +1,119 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const slugMaxLength = 64
+
+var (
+	slugPattern       = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+	slugInvalidChars  = regexp.MustCompile(`[^a-z0-9]+`)
+	publicFeedFormats = map[string]FeedFormat{"rss": FormatRSS, "atom": FormatAtom, "json": FormatJSONFeed}
+)
+
+// PublicFeed is a public feed, as found from the url it is served at.
+type PublicFeed struct {
+	Owner  User
+	FeedID RecordID
+	// Slug is the current slug of the feed, which differs from the requested
+	// one if the feed was renamed since
+	Slug string
+}
+
+// ParsePublicFeedFile splits the last part of the url of a public feed
+// document into the slug of the feed and the format of the document.
+func ParsePublicFeedFile(file string) (string, FeedFormat, bool) {
+	idx := strings.LastIndex(file, ".")
+	if idx < 0 {
+		return "", "", false
+	}
+	format, ok := publicFeedFormats[file[idx+1:]]
+	return file[:idx], format, ok
+}
+
+func slugify(title string) string {
+	slug := strings.Trim(slugInvalidChars.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if len(slug) > slugMaxLength {
+		slug = strings.TrimRight(slug[:slugMaxLength], "-")
+	}
+	return slug
+}
+
+// checkFeedSlug normalizes the slug of a feed. Public feeds get one from
+// their title if they have none, and their owner must have a username.
+func checkFeedSlug(user User, feed *Feed) error {
+	feed.Slug = strings.ToLower(strings.TrimSpace(feed.Slug))
+	if feed.Public {
+		if user.Username == "" {
+			return ErrNoUsername
+		}
+		if feed.Slug == "" {
+			feed.Slug = slugify(feed.Title)
+		}
+	}
+	if (feed.Public || feed.Slug != "") && !slugPattern.MatchString(feed.Slug) {
+		return ErrInvalidName
+	}
+	return nil
+}
+
+// keepFormerSlug remembers the slug a feed is about to leave, so that its
+// former url redirects to the new one.
+func (fs *Feeds) keepFormerSlug(user User, feed *Feed, tx *sql.Tx) error {
+	var slug sql.NullString
+	err := tx.QueryRow("SELECT slug FROM feeds WHERE id=$1 AND owner_id=$2 FOR UPDATE", feed.ID, user.ID).Scan(&slug)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	} else if !slug.Valid || slug.String == feed.Slug {
+		return nil
+	}
+
+	// a slug names the feed that had it last
+	_, err = tx.Exec("DELETE FROM feed_slug_history WHERE owner_id=$1 AND slug IN ($2, $3)", user.ID, slug.String, feed.Slug)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO feed_slug_history(owner_id, slug, feed_id) VALUES($1, $2, $3)", user.ID, slug.String, feed.ID)
+	if err != nil {
+		return fmt.Errorf("unable to keep former slug %v of feed %v: %v", slug.String, feed.ID, err)
+	}
+	return nil
+}
+
+// ResolvePublicFeed finds the public feed served at a username and slug,
+// which may be a former slug of the feed.
+func (fs *Feeds) ResolvePublicFeed(username string, slug string) (PublicFeed, error) {
+	pub := PublicFeed{}
+	err := fs.db.QueryRow(`SELECT users.id, users.email, users.username, feeds.id, feeds.slug
+		FROM feeds INNER JOIN users ON users.id = feeds.owner_id
+		WHERE users.username=$1 AND feeds.public AND feeds.slug IS NOT NULL AND (feeds.slug=$2 OR feeds.id IN (
+			SELECT feed_id FROM feed_slug_history WHERE owner_id=users.id AND slug=$2
+		))
+		ORDER BY feeds.slug=$2 DESC LIMIT 1`,
+		strings.ToLower(username), strings.ToLower(slug)).Scan(&pub.Owner.ID, &pub.Owner.Email, &pub.Owner.Username, &pub.FeedID, &pub.Slug)
+	if err == sql.ErrNoRows {
+		return PublicFeed{}, ErrNotFound
+	} else if err != nil {
+		return PublicFeed{}, err
+	}
+	return pub, nil
+}
+
+// PublicURL is the url of the public documents of a feed, without their
+// extension.
+func (fs *Feeds) PublicURL(pub PublicFeed) string {
+	return fs.config.rootURL() + "/p/" + pub.Owner.Username + "/" + pub.Slug
+}
+
+// GetPublic returns a document of a public feed. Its links point to the
+// public documents, and those that need a token are left out.
+func (fs *Feeds) GetPublic(pub PublicFeed, feedFormat FeedFormat, opts FeedOptions) (FeedData, error) {
+	opts.PublicURL = fs.PublicURL(pub)
+	return fs.Get(pub.Owner, pub.FeedID, feedFormat, opts)
+}
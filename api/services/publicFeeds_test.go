@@ -0,0 +1,72 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePublicFeedFile(t *testing.T) {
+	tests := []struct {
+		file   string
+		slug   string
+		format FeedFormat
+		ok     bool
+	}{
+		{"go-news.rss", "go-news", FormatRSS, true},
+		{"go-news.atom", "go-news", FormatAtom, true},
+		{"go-news.json", "go-news", FormatJSONFeed, true},
+		{"go-news.opml", "go-news", "", false},
+		{"go-news", "", "", false},
+	}
+	for _, test := range tests {
+		slug, format, ok := ParsePublicFeedFile(test.file)
+		if ok != test.ok || (ok && (slug != test.slug || format != test.format)) {
+			t.Errorf("expected %v to be parsed as %q, %q, %v, got %q, %q, %v", test.file, test.slug, test.format, test.ok, slug, format, ok)
+		}
+	}
+}
+
+func TestCheckFeedSlug(t *testing.T) {
+	user := User{ID: "user", Username: "alice"}
+
+	feed := Feed{Title: "  Go & Rust: Weekly News! ", Public: true}
+	if err := checkFeedSlug(user, &feed); err != nil || feed.Slug != "go-rust-weekly-news" {
+		t.Errorf("expected slug from title, got %q, error %v", feed.Slug, err)
+	}
+
+	feed = Feed{Title: "News", Slug: " My-News "}
+	if err := checkFeedSlug(user, &feed); err != nil || feed.Slug != "my-news" {
+		t.Errorf("expected normalized slug, got %q, error %v", feed.Slug, err)
+	}
+
+	for _, feed := range []Feed{{Title: "News", Slug: "my.news"}, {Title: "!!!", Public: true}} {
+		if err := checkFeedSlug(user, &feed); err != ErrInvalidName {
+			t.Errorf("expected slug of %#v to be invalid, got %v", feed, err)
+		}
+	}
+
+	feed = Feed{Title: "News", Public: true}
+	if err := checkFeedSlug(User{ID: "user"}, &feed); err != ErrNoUsername {
+		t.Errorf("expected public feed to require a username, got %v", err)
+	}
+}
+
+func TestPublicAtomHasNoEmail(t *testing.T) {
+	db, tx := beginTestTx(t)
+	defer db.Close()
+	defer tx.Rollback()
+	user, feedID := insertTestFeed(t, tx, true)
+
+	var doc string
+	err := tx.QueryRow("SELECT feed_atom($1, $2, $3::json)", feedID, user.ID,
+		`{"baseURL": "https://example.com/api/v1", "publicURL": "https://example.com/p/alice/news"}`).Scan(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(doc, "<email>") || strings.Contains(doc, "alice.smith") {
+		t.Errorf("expected public document to contain no email, got %v", doc)
+	}
+	if !strings.Contains(doc, "<name>alice</name>") {
+		t.Errorf("expected public document to be authored by the username, got %v", doc)
+	}
+}
@@ -0,0 +1,231 @@
+package services
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// the main article of a page is found in the manner of readability: paragraphs
+// give points to their parent and grandparent, and the container with the best
+// score, adjusted for the density of links in it, wins.
+
+const articleMinLength = 140
+
+// elements that never are part of an article
+var articleSkippedElements = map[string]bool{
+	"aside": true, "button": true, "footer": true, "form": true, "header": true, "iframe": true, "input": true,
+	"nav": true, "noscript": true, "object": true, "script": true, "select": true, "style": true, "svg": true, "textarea": true,
+}
+
+var (
+	articleUnlikely = regexp.MustCompile(`(?i)banner|breadcrumb|comment|community|cookie|disqus|footer|menu|modal|nav|popup|related|share|sidebar|social|sponsor|subscribe|widget|\bads?\b`)
+	articlePositive = regexp.MustCompile(`(?i)article|body|content|entry|main|page|post|story|text`)
+	articleNegative = regexp.MustCompile(`(?i)byline|comment|footer|meta|promo|related|share|sidebar|social|tags|widget`)
+)
+
+// elements kept by sanitizeArticle; any other element is unwrapped, keeping
+// its content.
+var articleAllowedElements = map[string]bool{
+	"a": true, "b": true, "blockquote": true, "br": true, "caption": true, "cite": true, "code": true, "dd": true, "dl": true, "dt": true,
+	"em": true, "figcaption": true, "figure": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "hr": true,
+	"i": true, "img": true, "kbd": true, "li": true, "mark": true, "ol": true, "p": true, "pre": true, "q": true, "s": true, "small": true,
+	"strong": true, "sub": true, "sup": true, "table": true, "tbody": true, "td": true, "tfoot": true, "th": true, "thead": true, "tr": true,
+	"u": true, "ul": true,
+}
+
+// extractArticle returns the sanitized html of the main article of the page,
+// or an empty string if the page doesn't seem to have one.
+func extractArticle(page fetchedPage) string {
+	root := parseHTMLTree(page.html)
+	scores := map[*htmlNode]float64{}
+
+	root.walk(func(node *htmlNode) bool {
+		if node.name == "" || isUnlikelyArticleNode(node) {
+			return false
+		}
+		switch node.name {
+		case "p", "pre", "td", "blockquote":
+		default:
+			return true
+		}
+
+		text := node.textContent()
+		if len(text) < 25 {
+			return false
+		}
+		score := 1 + float64(strings.Count(text, ",")) + minFloat(float64(len(text))/100, 3)
+		if parent := node.parent; parent != nil && parent.name != "#document" {
+			initArticleScore(scores, parent)
+			scores[parent] += score
+			if grandparent := parent.parent; grandparent != nil && grandparent.name != "#document" {
+				initArticleScore(scores, grandparent)
+				scores[grandparent] += score / 2
+			}
+		}
+		return false
+	})
+
+	// candidates are ranked in document order, so that the first one wins ties
+	var top *htmlNode
+	topScore := 0.0
+	root.walk(func(node *htmlNode) bool {
+		score, scored := scores[node]
+		if !scored {
+			return true
+		}
+		score *= 1 - linkDensity(node)
+		scores[node] = score
+		if top == nil || score > topScore {
+			top, topScore = node, score
+		}
+		return true
+	})
+	if top == nil {
+		return ""
+	}
+
+	// siblings scoring well enough are likely parts of the same article,
+	// split by the layout
+	nodes := []*htmlNode{top}
+	if top.parent != nil {
+		nodes = nil
+		threshold := maxFloat(10, topScore*0.2)
+		for _, sibling := range top.parent.children {
+			if sibling == top || scores[sibling] >= threshold {
+				nodes = append(nodes, sibling)
+			}
+		}
+	}
+
+	length := 0
+	for _, node := range nodes {
+		length += len(node.textContent())
+	}
+	if length < articleMinLength {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		sanitizeArticle(&buf, node, page.url)
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+func initArticleScore(scores map[*htmlNode]float64, node *htmlNode) {
+	if _, exists := scores[node]; exists {
+		return
+	}
+	score := 0.0
+	switch node.name {
+	case "article":
+		score += 10
+	case "div", "main", "section":
+		score += 5
+	case "pre", "td", "blockquote":
+		score += 3
+	case "ol", "ul", "dl", "dd", "dt", "li", "form":
+		score -= 3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		score -= 5
+	}
+	for _, attr := range []string{node.attr("class"), node.attr("id")} {
+		if articlePositive.MatchString(attr) {
+			score += 25
+		}
+		if articleNegative.MatchString(attr) {
+			score -= 25
+		}
+	}
+	scores[node] = score
+}
+
+func isUnlikelyArticleNode(node *htmlNode) bool {
+	if articleSkippedElements[node.name] {
+		return true
+	}
+	if node.name == "body" || node.name == "article" || node.name == "main" {
+		return false
+	}
+	attrs := node.attr("class") + " " + node.attr("id")
+	return articleUnlikely.MatchString(attrs) && !articlePositive.MatchString(attrs)
+}
+
+// linkDensity is the share of the text of node that is inside links.
+func linkDensity(node *htmlNode) float64 {
+	textLength := len(node.textContent())
+	if textLength == 0 {
+		return 0
+	}
+	linkLength := 0
+	node.walk(func(n *htmlNode) bool {
+		if n.name == "a" {
+			linkLength += len(n.textContent())
+			return false
+		}
+		return true
+	})
+	return float64(linkLength) / float64(textLength)
+}
+
+// sanitizeArticle writes node as html, keeping only the presentational
+// elements and the attributes needed for links and images. Links are made
+// absolute, and those not using http(s) are dropped.
+func sanitizeArticle(buf *bytes.Buffer, node *htmlNode, base *url.URL) {
+	if node.name == "" {
+		buf.WriteString(html.EscapeString(node.text))
+		return
+	}
+	if isUnlikelyArticleNode(node) {
+		return
+	}
+
+	allowed := articleAllowedElements[node.name]
+	if allowed {
+		attrs := ""
+		switch node.name {
+		case "a":
+			if href := resolveLink(base, strings.TrimSpace(node.attr("href"))); href != "" {
+				attrs = ` href="` + html.EscapeString(href) + `"`
+			}
+		case "img":
+			src := resolveLink(base, strings.TrimSpace(node.attr("src")))
+			if src == "" {
+				return
+			}
+			attrs = ` src="` + html.EscapeString(src) + `"`
+			if alt := node.attr("alt"); alt != "" {
+				attrs += ` alt="` + html.EscapeString(alt) + `"`
+			}
+		}
+		buf.WriteString("<" + node.name + attrs + ">")
+		if htmlVoidElements[node.name] {
+			return
+		}
+	}
+
+	for _, child := range node.children {
+		sanitizeArticle(buf, child, base)
+	}
+
+	if allowed {
+		buf.WriteString("</" + node.name + ">")
+	}
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testArticlePage = `<html><head><title>An article</title><script>var x = "<p>not content</p>";</script></head>
+<body>
+  <nav class="menu"><ul><li><a href="/">Home</a></li><li><a href="/about">About, us, and more, and more</a></li></ul></nav>
+  <div id="main-content">
+    <div class="post-body">
+      <h1>The title</h1>
+      <p>The first paragraph of the article, which is long enough, with commas, to count as content.
+      <p onclick="alert(1)">A second paragraph, with <a href="/other" style="color:red">a relative link</a> and
+         <a href="javascript:alert(1)">a bad one</a>, and some more words to be long enough.</p>
+      <img src="/image.png" alt="a picture" onerror="alert(1)">
+      <p>A third paragraph<script>alert(1)</script>, also long enough to be counted as part of the article.</p>
+    </div>
+    <div class="share social"><p>Share this article on all the social networks, now, please, thank you.</p></div>
+  </div>
+  <footer><p>Copyright notice, long enough to look like a paragraph of text, but not content.</p></footer>
+</body></html>`
+
+func TestExtractArticle(t *testing.T) {
+	base, _ := url.Parse("https://example.com/posts/1")
+	content := extractArticle(fetchedPage{url: base, html: testArticlePage})
+
+	for _, expected := range []string{
+		"<h1>The title</h1>",
+		"<p>The first paragraph of the article",
+		`<a href="https://example.com/other">a relative link</a>`,
+		"<a>a bad one</a>",
+		`<img src="https://example.com/image.png" alt="a picture">`,
+		"<p>A third paragraph, also long enough",
+	} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("expected content to contain %q, got %q", expected, content)
+		}
+	}
+
+	for _, unexpected := range []string{"alert", "onclick", "style", "Home", "Share this", "Copyright", "not content", "<div"} {
+		if strings.Contains(content, unexpected) {
+			t.Errorf("expected content not to contain %q, got %q", unexpected, content)
+		}
+	}
+}
+
+func TestExtractArticleWithoutArticle(t *testing.T) {
+	content := extractArticle(fetchedPage{html: `<html><body><ul><li><a href="/a">a link</a></li></ul><p>Short.</p></body></html>`})
+	if content != "" {
+		t.Errorf("expected no content, got %q", content)
+	}
+}
+
+func TestExtractArticleTiesGoToTheFirst(t *testing.T) {
+	paragraph := strings.Repeat("A paragraph long enough to count as the content of an article, ", 3)
+	page := fetchedPage{html: `<html><body>
+  <section><div><p>first ` + paragraph + `</p></div></section>
+  <section><div><p>other ` + paragraph + `</p></div></section>
+</body></html>`}
+	page.url, _ = url.Parse("https://example.com/")
+
+	for attempt := 0; attempt < 20; attempt++ {
+		content := extractArticle(page)
+		if !strings.Contains(content, "first") || strings.Contains(content, "other") {
+			t.Fatalf("expected the first of the tied candidates, got %v", content)
+		}
+	}
+}
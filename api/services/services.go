@@ -18,8 +18,15 @@ type Services struct {
 }
 
 var (
-	ErrUniqueViolation = fmt.Errorf("unique_violation")
-	ErrNotFound        = fmt.Errorf("not_found")
+	ErrUniqueViolation   = fmt.Errorf("unique_violation")
+	ErrNotFound          = fmt.Errorf("not_found")
+	ErrSmartFeedItems    = fmt.Errorf("smart_feed_items")
+	ErrEmailDisabled     = fmt.Errorf("email_disabled")
+	ErrDuplicateItem     = fmt.Errorf("duplicate_item")
+	ErrUnknownTopic      = fmt.Errorf("unknown_topic")
+	ErrInvalidName       = fmt.Errorf("invalid_name")
+	ErrNoUsername        = fmt.Errorf("no_username")
+	ErrInvalidSmartQuery = fmt.Errorf("invalid_smart_query")
 )
 
 func New() (*Services, error) {
@@ -47,6 +54,12 @@ func New() (*Services, error) {
 		return nil, err
 	}
 
+	if config.inboundEmailEnabled() {
+		if err := startInboundEmail(config, feeds); err != nil {
+			return nil, err
+		}
+	}
+
 	svc := &Services{Users: users, Feeds: feeds}
 
 	return svc, nil
@@ -108,6 +121,33 @@ func newID() RecordID {
 	return RecordID(u4str)
 }
 
+// how many rows claimed by a background loop (sources to poll, links to
+// check, webhooks to deliver) are processed at once
+const claimedRowsConcurrency = 8
+
+// processClaimedRows calls process for each of the count rows claimed by a
+// background loop, a few at a time, and returns once all are done. Loops
+// claim due rows by pushing back their next run with a query that skips rows
+// locked by other instances, so that a slow run doesn't get started again by
+// the next tick or by another instance.
+func processClaimedRows(count int, process func(idx int)) {
+	sem := make(chan struct{}, claimedRowsConcurrency)
+	done := make(chan struct{})
+	for idx := 0; idx < count; idx++ {
+		go func(idx int) {
+			sem <- struct{}{}
+			defer func() {
+				<-sem
+				done <- struct{}{}
+			}()
+			process(idx)
+		}(idx)
+	}
+	for idx := 0; idx < count; idx++ {
+		<-done
+	}
+}
+
 func dumpQueryResults(rows *sql.Rows) {
 	defer rows.Close()
 	cols, err := rows.Columns()
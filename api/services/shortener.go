@@ -0,0 +1,165 @@
+package services
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// the shorteners that can be configured
+const (
+	ShortenerBuiltin = "builtin"
+	ShortenerBitly   = "bitly"
+	ShortenerNone    = "none"
+)
+
+const (
+	shortCodeLength   = 7
+	shortCodeAttempts = 5
+	shortCodeAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+)
+
+var shortCodePattern = regexp.MustCompile(`^[0-9a-zA-Z]{1,16}$`)
+
+var bitlyClient = &http.Client{Timeout: 10 * time.Second}
+
+// Shortener makes short links to long urls.
+type Shortener interface {
+	Shorten(longURL string) (string, error)
+}
+
+func newShortener(config Config, db *sql.DB) (Shortener, error) {
+	builtin := &builtinShortener{db: db, baseURL: config.shortURLBase()}
+	switch config.Shortener {
+	case "", ShortenerBuiltin:
+		return builtin, nil
+	case ShortenerBitly:
+		if config.BitlyAPIKey == "" {
+			return nil, fmt.Errorf("the bitly shortener requires BITLY_API_KEY")
+		}
+		return &bitlyShortener{apiKey: config.BitlyAPIKey, fallback: builtin}, nil
+	case ShortenerNone:
+		return noShortener{}, nil
+	default:
+		return nil, fmt.Errorf("unknown url shortener %q", config.Shortener)
+	}
+}
+
+// builtinShortener stores short codes in the database, and its links are
+// redirected by the api itself.
+type builtinShortener struct {
+	db      *sql.DB
+	baseURL string
+}
+
+func (s *builtinShortener) Shorten(longURL string) (string, error) {
+	var code string
+	err := s.db.QueryRow("SELECT code FROM short_links WHERE url=$1", longURL).Scan(&code)
+	if err == nil {
+		return s.baseURL + "/s/" + code, nil
+	} else if err != sql.ErrNoRows {
+		return "", fmt.Errorf("unable to find short link of %v: %v", longURL, err)
+	}
+
+	// codes are random, so a new one is tried if it is already taken
+	for attempt := 1; ; attempt++ {
+		code, err := newShortCode()
+		if err != nil {
+			return "", err
+		}
+		_, err = s.db.Exec("INSERT INTO short_links(code, url) VALUES($1, $2)", code, longURL)
+		if err == nil {
+			return s.baseURL + "/s/" + code, nil
+		} else if !isUniqueError(err) || attempt >= shortCodeAttempts {
+			return "", fmt.Errorf("unable to create short link of %v: %v", longURL, err)
+		}
+	}
+}
+
+func newShortCode() (string, error) {
+	bytes := make([]byte, shortCodeLength)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	for idx, b := range bytes {
+		bytes[idx] = shortCodeAlphabet[int(b)%len(shortCodeAlphabet)]
+	}
+	return string(bytes), nil
+}
+
+// ResolveShortLink returns the url a short code of the builtin shortener
+// stands for.
+func (fs *Feeds) ResolveShortLink(code string) (string, error) {
+	if !shortCodePattern.MatchString(code) {
+		return "", ErrNotFound
+	}
+	var longURL string
+	err := fs.db.QueryRow("SELECT url FROM short_links WHERE code=$1", code).Scan(&longURL)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return longURL, nil
+}
+
+// bitlyShortener uses the bit.ly api, or the fallback shortener when bit.ly
+// fails.
+type bitlyShortener struct {
+	apiKey   string
+	fallback Shortener
+}
+
+func (s *bitlyShortener) Shorten(longURL string) (string, error) {
+	shortURL, err := s.shortenWithBitly(longURL)
+	if err != nil {
+		log.Printf("%v, using the builtin shortener", err)
+		return s.fallback.Shorten(longURL)
+	}
+	return shortURL, nil
+}
+
+func (s *bitlyShortener) shortenWithBitly(longURL string) (string, error) {
+	url := fmt.Sprintf("https://api-ssl.bitly.com/v3/user/link_save?access_token=%s&longUrl=%s", s.apiKey, url.QueryEscape(longURL))
+	resp, err := bitlyClient.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("bitly: failed to exec request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("bitly: failed to read response: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("bitly: request returned %v status, body %s", resp.StatusCode, string(body))
+	}
+
+	var shortenerRes struct {
+		Data struct{ Link_Save struct{ Link string } }
+	}
+	err = json.Unmarshal(body, &shortenerRes)
+	if err != nil {
+		return "", fmt.Errorf("bitly: request returned unparsable body %v: %v", string(body), err)
+	}
+
+	shortURL := shortenerRes.Data.Link_Save.Link
+	if shortURL == "" {
+		return "", fmt.Errorf("bitly: request returned unexpected body %v: parsed: %#v", string(body), shortenerRes)
+	}
+
+	return shortURL, nil
+}
+
+// noShortener keeps urls as they are.
+type noShortener struct{}
+
+func (noShortener) Shorten(longURL string) (string, error) {
+	return longURL, nil
+}
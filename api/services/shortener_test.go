@@ -0,0 +1,47 @@
+package services
+
+import "testing"
+
+func TestNewShortCode(t *testing.T) {
+	seen := map[string]bool{}
+	for idx := 0; idx < 100; idx++ {
+		code, err := newShortCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != shortCodeLength || !shortCodePattern.MatchString(code) {
+			t.Errorf("invalid short code %q", code)
+		}
+		seen[code] = true
+	}
+	if len(seen) < 100 {
+		t.Errorf("expected short codes to be unique, got %v distinct codes", len(seen))
+	}
+}
+
+func TestShortURLBase(t *testing.T) {
+	config := Config{PublicURL: "https://example.com/api/v1"}
+	if base := config.shortURLBase(); base != "https://example.com" {
+		t.Errorf("expected base from public url, got %v", base)
+	}
+	config.ShortURLBase = "https://ex.am/"
+	if base := config.shortURLBase(); base != "https://ex.am" {
+		t.Errorf("expected configured base, got %v", base)
+	}
+}
+
+func TestNewShortener(t *testing.T) {
+	if s, err := newShortener(Config{}, nil); err != nil {
+		t.Error(err)
+	} else if _, ok := s.(*builtinShortener); !ok {
+		t.Errorf("expected builtin shortener by default, got %T", s)
+	}
+	if _, err := newShortener(Config{Shortener: ShortenerBitly}, nil); err == nil {
+		t.Error("expected bitly shortener without an api key to be rejected")
+	}
+	if s, err := newShortener(Config{Shortener: ShortenerNone}, nil); err != nil {
+		t.Error(err)
+	} else if short, _ := s.Shorten("https://example.com/long"); short != "https://example.com/long" {
+		t.Errorf("expected url to be kept, got %v", short)
+	}
+}
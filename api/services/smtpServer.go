@@ -0,0 +1,176 @@
+package services
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const (
+	smtpMaxMessageSize = 10 << 20
+	smtpMaxLineLength  = 1000 // including the CRLF, as in rfc 5321
+	// what is read of the data of a message, dot-stuffing included, before
+	// the connection is dropped
+	smtpMaxDataSize    = smtpMaxMessageSize + smtpMaxMessageSize/2
+	smtpMaxRecipients  = 100
+	smtpCommandTimeout = 5 * time.Minute
+)
+
+// smtpServer is a minimal SMTP server, only good enough to receive mail
+// from other servers: it neither relays nor authenticates.
+type smtpServer struct {
+	hostname        string
+	acceptRecipient func(recipient string) bool
+	deliver         func(recipients []string, data []byte) error
+}
+
+func (s *smtpServer) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+	// what is read from the client is capped, so that a line or a message
+	// that never ends can't exhaust memory: command lines must fit in the
+	// buffer, and messages in what is left to read
+	input := &io.LimitedReader{R: conn}
+	buffered := bufio.NewReaderSize(input, smtpMaxLineLength)
+	reader := textproto.NewReader(buffered)
+	writer := textproto.NewWriter(bufio.NewWriter(conn))
+
+	var from string
+	var recipients []string
+	reset := func() {
+		from = ""
+		recipients = nil
+	}
+
+	reply := func(format string, args ...interface{}) bool {
+		conn.SetDeadline(time.Now().Add(smtpCommandTimeout))
+		return writer.PrintfLine(format, args...) == nil
+	}
+
+	if !reply("220 %s ESMTP myfeeds", s.hostname) {
+		return
+	}
+	for {
+		input.N = smtpMaxDataSize
+		raw, err := buffered.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			reply("500 Line too long")
+			return
+		} else if err != nil {
+			return
+		}
+		line := strings.TrimRight(string(raw), "\r\n")
+		verb, arg := line, ""
+		if idx := strings.IndexByte(line, ' '); idx >= 0 {
+			verb, arg = line[:idx], strings.TrimSpace(line[idx+1:])
+		}
+
+		var ok bool
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			ok = reply("250 %s", s.hostname)
+		case "EHLO":
+			ok = reply("250-%s", s.hostname) && reply("250-SIZE %d", smtpMaxMessageSize) && reply("250 8BITMIME")
+		case "MAIL":
+			address, valid := smtpPathArg(arg, "FROM:")
+			if !valid {
+				ok = reply("501 Syntax: MAIL FROM:<address>")
+				break
+			}
+			reset()
+			from = address
+			ok = reply("250 OK")
+		case "RCPT":
+			address, valid := smtpPathArg(arg, "TO:")
+			switch {
+			case from == "":
+				ok = reply("503 MAIL first")
+			case !valid || address == "":
+				ok = reply("501 Syntax: RCPT TO:<address>")
+			case len(recipients) >= smtpMaxRecipients:
+				ok = reply("452 Too many recipients")
+			case !s.acceptRecipient(address):
+				ok = reply("550 No such mailbox")
+			default:
+				recipients = append(recipients, address)
+				ok = reply("250 OK")
+			}
+		case "DATA":
+			if len(recipients) == 0 {
+				ok = reply("503 RCPT first")
+				break
+			}
+			if !reply("354 End data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			input.N = smtpMaxDataSize
+			ok = s.receiveData(reader.DotReader(), recipients, reply)
+			reset()
+		case "RSET":
+			reset()
+			ok = reply("250 OK")
+		case "NOOP":
+			ok = reply("250 OK")
+		case "VRFY":
+			ok = reply("252 Cannot verify user")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			ok = reply("502 Command not implemented")
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+func (s *smtpServer) receiveData(body io.Reader, recipients []string, reply func(string, ...interface{}) bool) bool {
+	data, err := ioutil.ReadAll(io.LimitReader(body, smtpMaxMessageSize+1))
+	if err != nil {
+		return false
+	}
+	if len(data) > smtpMaxMessageSize {
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			return false
+		}
+		return reply("552 Message too large")
+	}
+
+	if err := s.deliver(recipients, data); err != nil {
+		log.Printf("unable to deliver message to %v: %v", recipients, err)
+		return reply("451 Unable to process message")
+	}
+	return reply("250 OK")
+}
+
+// smtpPathArg extracts the address out of the argument of MAIL and RCPT
+// commands, such as "FROM:<john@example.com> SIZE=1234".
+func smtpPathArg(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(path, "<") {
+		return "", false
+	}
+	end := strings.IndexByte(path, '>')
+	if end < 0 {
+		return "", false
+	}
+	return path[1:end], true
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	snapshotMaxSize      = 10 << 20 // the page and its inlined assets
+	snapshotMaxAssetSize = 2 << 20
+)
+
+// elements left out of snapshots, along with their content
+var snapshotSkippedElements = map[string]bool{"script": true, "iframe": true, "object": true, "embed": true}
+
+var cssURLPattern = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^'")\s]*))\s*\)`)
+
+// fetchAsset gets an asset of a page, of at most maxSize bytes. It returns
+// its data and its media type.
+type fetchAsset func(link string, maxSize int) ([]byte, string, error)
+
+// snapshotter builds a self-contained copy of a page: scripts are removed, and
+// images, stylesheets and the assets they refer to are inlined as data urls,
+// as long as the snapshot stays under its size cap. Assets that don't fit are
+// left as absolute links.
+type snapshotter struct {
+	fetch     fetchAsset
+	remaining int
+	dataURLs  map[string]string
+}
+
+func buildSnapshot(page fetchedPage, fetch fetchAsset) (string, error) {
+	if len(page.html) > snapshotMaxSize {
+		return "", fmt.Errorf("page is larger than %v bytes", snapshotMaxSize)
+	}
+	s := &snapshotter{fetch: fetch, remaining: snapshotMaxSize - len(page.html), dataURLs: map[string]string{}}
+
+	var buf bytes.Buffer
+	base := `<base href="` + html.EscapeString(page.url.String()) + `">`
+	hasBase := false
+	skipping, inStyle := "", false
+
+	tokenizeHTML(page.html, func(tok htmlToken) bool {
+		if skipping != "" {
+			if tok.kind == htmlEndTag && tok.name == skipping {
+				skipping = ""
+			}
+			return true
+		}
+
+		switch tok.kind {
+		case htmlText:
+			if inStyle {
+				buf.WriteString(s.inlineCSS(page.url, tok.raw))
+			} else {
+				buf.WriteString(tok.raw)
+			}
+			return true
+		case htmlEndTag:
+			inStyle = false
+			buf.WriteString(tok.raw)
+			return true
+		case htmlComment:
+			buf.WriteString(tok.raw)
+			return true
+		}
+
+		if snapshotSkippedElements[tok.name] {
+			if !tok.selfClosing && !htmlVoidElements[tok.name] {
+				skipping = tok.name
+			}
+			return true
+		}
+
+		switch tok.name {
+		case "base", "source":
+			// links are resolved against the page's url, and <picture>
+			// alternatives would not be inlined
+		case "head", "html":
+			buf.WriteString(tok.raw)
+			if tok.name == "head" && !hasBase {
+				buf.WriteString(base)
+				hasBase = true
+			}
+		case "style":
+			inStyle = !tok.selfClosing
+			buf.WriteString(tok.raw)
+		case "link":
+			if hasHTMLToken(tok.attr("rel"), "stylesheet") {
+				if css, ok := s.fetchStylesheet(page.url, tok.attr("href")); ok {
+					buf.WriteString("<style>" + css + "</style>")
+					break
+				}
+			}
+			buf.WriteString(tok.raw)
+		case "img":
+			attrs := map[string]string{}
+			for name, value := range tok.attrs {
+				if name != "srcset" && name != "sizes" {
+					attrs[name] = value
+				}
+			}
+			if dataURL, ok := s.inline(page.url, tok.attr("src")); ok {
+				attrs["src"] = dataURL
+			}
+			buf.WriteString(formatHTMLStartTag(tok.name, attrs))
+		default:
+			if !hasBase {
+				buf.WriteString(base)
+				hasBase = true
+			}
+			buf.WriteString(tok.raw)
+		}
+		return true
+	})
+	return buf.String(), nil
+}
+
+// inline returns the data url of the asset at link, relative to base.
+func (s *snapshotter) inline(base *url.URL, link string) (string, bool) {
+	link = resolveLink(base, strings.TrimSpace(link))
+	if link == "" {
+		return "", false
+	}
+	if dataURL, ok := s.dataURLs[link]; ok {
+		return dataURL, true
+	}
+	data, mediaType, err := s.fetchWithinBudget(link)
+	if err != nil {
+		return "", false
+	}
+	dataURL := "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	s.dataURLs[link] = dataURL
+	return dataURL, true
+}
+
+func (s *snapshotter) fetchWithinBudget(link string) ([]byte, string, error) {
+	maxSize := snapshotMaxAssetSize
+	if s.remaining < maxSize {
+		maxSize = s.remaining
+	}
+	// base64 takes a third more room than the data
+	data, mediaType, err := s.fetch(link, maxSize*3/4)
+	if err != nil {
+		return nil, "", err
+	}
+	s.remaining -= base64.StdEncoding.EncodedLen(len(data))
+	return data, mediaType, nil
+}
+
+func (s *snapshotter) fetchStylesheet(base *url.URL, link string) (string, bool) {
+	link = resolveLink(base, strings.TrimSpace(link))
+	if link == "" {
+		return "", false
+	}
+	data, _, err := s.fetchWithinBudget(link)
+	if err != nil {
+		return "", false
+	}
+	cssURL, _ := url.Parse(link)
+	// the stylesheet ends up in a <style> element, which it must not close
+	css := strings.Replace(string(data), "</", `<\/`, -1)
+	return s.inlineCSS(cssURL, css), true
+}
+
+// inlineCSS replaces the url() references of a stylesheet with data urls, or
+// absolute urls for those that can't be inlined.
+func (s *snapshotter) inlineCSS(base *url.URL, css string) string {
+	return cssURLPattern.ReplaceAllStringFunc(css, func(ref string) string {
+		groups := cssURLPattern.FindStringSubmatch(ref)
+		link := firstNonEmpty(groups[1], groups[2], groups[3])
+		if link == "" || strings.HasPrefix(link, "data:") || strings.HasPrefix(link, "#") {
+			return ref
+		}
+		if dataURL, ok := s.inline(base, link); ok {
+			return `url("` + dataURL + `")`
+		}
+		if absolute := resolveLink(base, link); absolute != "" {
+			return `url("` + absolute + `")`
+		}
+		return ref
+	})
+}
+
+func formatHTMLStartTag(name string, attrs map[string]string) string {
+	names := make([]string, 0, len(attrs))
+	for attrName := range attrs {
+		names = append(names, attrName)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString("<" + name)
+	for _, attrName := range names {
+		buf.WriteString(" " + attrName + `="` + html.EscapeString(attrs[attrName]) + `"`)
+	}
+	buf.WriteString(">")
+	return buf.String()
+}
+
+func fetchPageAsset(link string, maxSize int) ([]byte, string, error) {
+	resp, err := pageClient.Get(link)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetching %v returned %v status", link, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(maxSize)+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxSize {
+		return nil, "", fmt.Errorf("%v is larger than %v bytes", link, maxSize)
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = http.DetectContentType(data)
+	}
+	return data, mediaType, nil
+}
+
+func snapshotKey(item FeedItem, user User) string {
+	return string(user.ID) + "/" + string(item.ID) + ".html"
+}
+
+// saveSnapshot stores the snapshot of the page of an item.
+func (fs *Feeds) saveSnapshot(user User, item FeedItem, page fetchedPage) error {
+	snapshot, err := buildSnapshot(page, fetchPageAsset)
+	if err != nil {
+		return err
+	}
+	key := snapshotKey(item, user)
+	if err := fs.snapshots.Put(key, []byte(snapshot)); err != nil {
+		return err
+	}
+	_, err = fs.db.Exec("UPDATE feed_items SET snapshot_key=$1 WHERE id=$2 AND owner_id=$3", key, item.ID, user.ID)
+	if err != nil {
+		return fmt.Errorf("unable to save snapshot of item %v: %v", item.ID, err)
+	}
+	return nil
+}
+
+func (fs *Feeds) GetSnapshot(user User, feedID RecordID, itemID RecordID) ([]byte, error) {
+	var key sql.NullString
+	err := fs.db.QueryRow("SELECT snapshot_key FROM feed_items WHERE id=$1 AND feed_id=$2 AND owner_id=$3", itemID, feedID, user.ID).Scan(&key)
+	if err == sql.ErrNoRows || (err == nil && !key.Valid) || fs.snapshots == nil {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return fs.snapshots.Get(key.String)
+}
+
+// deleteSnapshots removes the snapshots of deleted items
+func (fs *Feeds) deleteSnapshots(keys []string) {
+	if fs.snapshots == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := fs.snapshots.Delete(key); err != nil {
+			log.Printf("unable to delete snapshot %v: %v", key, err)
+		}
+	}
+}
+
+// scanSnapshotKeys reads the snapshot_key column returned by a DELETE.
+func scanSnapshotKeys(rows *sql.Rows, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var key sql.NullString
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if key.Valid {
+			keys = append(keys, key.String)
+		}
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBuildSnapshot(t *testing.T) {
+	page := fetchedPage{html: `<!DOCTYPE html><html><head><base href="/other/">
+<link rel="stylesheet" href="style.css"><link rel="stylesheet" href="/huge.css">
+<script>alert(1)</script></head>
+<body><img src="img/a.png" srcset="img/a-2x.png 2x"><img src="img/a.png">
+<iframe src="https://ads.example.net/"><p>ad</p></iframe><a href="/next">next</a></body></html>`}
+	page.url, _ = url.Parse("https://example.com/posts/1")
+
+	assets := map[string]string{
+		"https://example.com/posts/style.css": `body { background: url('../bg.gif') } </style>`,
+		"https://example.com/bg.gif":          "GIF89a",
+		"https://example.com/posts/img/a.png": "PNG",
+		"https://example.com/huge.css":        strings.Repeat("x", snapshotMaxAssetSize),
+	}
+	fetched := map[string]int{}
+	fetch := func(link string, maxSize int) ([]byte, string, error) {
+		fetched[link]++
+		data, ok := assets[link]
+		if !ok || len(data) > maxSize {
+			return nil, "", fmt.Errorf("unable to fetch %v", link)
+		}
+		mediaType := "image/png"
+		if strings.HasSuffix(link, ".css") {
+			mediaType = "text/css"
+		} else if strings.HasSuffix(link, ".gif") {
+			mediaType = "image/gif"
+		}
+		return []byte(data), mediaType, nil
+	}
+
+	snapshot, err := buildSnapshot(page, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`<head><base href="https://example.com/posts/1">`,
+		`<style>body { background: url("data:image/gif;base64,R0lGODlh") } <\/style></style>`,
+		`<link rel="stylesheet" href="/huge.css">`,
+		`<img src="data:image/png;base64,UE5H">`,
+		`<a href="/next">next</a>`,
+	}
+	for _, fragment := range expected {
+		if !strings.Contains(snapshot, fragment) {
+			t.Errorf("expected snapshot to contain %q, got %v", fragment, snapshot)
+		}
+	}
+	for _, fragment := range []string{"/other/", "alert", "ads.example.net", "<p>ad</p>", "srcset"} {
+		if strings.Contains(snapshot, fragment) {
+			t.Errorf("expected %q to be removed from snapshot %v", fragment, snapshot)
+		}
+	}
+	if fetched["https://example.com/posts/img/a.png"] != 1 {
+		t.Errorf("expected image to be fetched once, got %v", fetched)
+	}
+}
+
+func TestFetchPageAssetRefusesLocalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "PNG")
+	}))
+	defer server.Close()
+
+	if _, _, err := fetchPageAsset(server.URL+"/a.png", snapshotMaxAssetSize); err == nil {
+		t.Error("expected an asset on a local address to be refused")
+	}
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, server.URL+"/a.png", http.StatusFound)
+	}))
+	defer redirect.Close()
+	if _, _, err := fetchPageAsset(redirect.URL, snapshotMaxAssetSize); err == nil {
+		t.Error("expected a redirect to a local address to be refused")
+	}
+}
+
+func TestFileBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newFileBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("user/item.html", []byte("snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := store.Get("user/item.html"); err != nil || string(data) != "snapshot" {
+		t.Errorf("unexpected blob %q, error %v", data, err)
+	}
+	if err := store.Delete("user/item.html"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("user/item.html"); err != ErrNotFound {
+		t.Errorf("expected deleted blob to be not found, got %v", err)
+	}
+	if err := store.Put("../escape", []byte("x")); err == nil {
+		t.Error("expected key outside of the store to be rejected")
+	}
+}
@@ -3,6 +3,8 @@ package services
 import (
 	"database/sql"
 	"fmt"
+	"log"
+	"regexp"
 	"strings"
 
 	"gopkg.in/redis.v3"
@@ -15,6 +17,7 @@ import (
 type User struct {
 	ID       RecordID `json:"id"`
 	Email    string   `json:"email"`
+	Username string   `json:"username,omitempty"` // part of the urls of public feeds
 	password string
 }
 
@@ -30,6 +33,8 @@ type Users struct {
 
 const bcryptCost = 8
 
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
 func newUsers(config Config, db *sql.DB, redisClient *redis.Client) (*Users, error) {
 	tokensStartDeleteExpiredLoop(db, tokenDeleteExpiredInterval)
 	return &Users{config, db, redisClient}, nil
@@ -89,8 +94,8 @@ func normalizeID(id string) string {
 func (users *Users) GetByID(id RecordID) (User, error) {
 	user := User{ID: id}
 	err := users.db.
-		QueryRow("SELECT email,password FROM users WHERE id=$1", id).
-		Scan(&user.Email, &user.password)
+		QueryRow("SELECT email,coalesce(username,''),password FROM users WHERE id=$1", id).
+		Scan(&user.Email, &user.Username, &user.password)
 	if err == sql.ErrNoRows {
 		return User{}, ErrNotFound
 	} else if err != nil {
@@ -103,8 +108,8 @@ func (users *Users) GetByID(id RecordID) (User, error) {
 func (users *Users) AuthenticateWithPassword(email string, password string) (User, error) {
 	user := User{Email: normalizeEmail(email)}
 	err := users.db.
-		QueryRow("SELECT id,password FROM users WHERE email=$1", user.Email).
-		Scan(&user.ID, &user.password)
+		QueryRow("SELECT id,coalesce(username,''),password FROM users WHERE email=$1", user.Email).
+		Scan(&user.ID, &user.Username, &user.password)
 	if err == sql.ErrNoRows {
 		return User{}, ErrNotFound
 	} else if err != nil {
@@ -120,12 +125,12 @@ func (users *Users) dbAuthenticateByToken(secret string) (User, Token, error) {
 	user := User{}
 	token := Token{Secret: secret}
 
-	query := `select users.id, users.email, access_tokens.access, access_tokens.expires
+	query := `select users.id, users.email, coalesce(users.username, ''), access_tokens.access, access_tokens.expires
 		FROM access_tokens INNER JOIN users ON users.id = access_tokens.user_id
 		WHERE access_token_is_valid($1, access_tokens.*)`
 	err := users.db.
 		QueryRow(query, secret).
-		Scan(&user.ID, &user.Email, &token.Access, &token.Expires)
+		Scan(&user.ID, &user.Email, &user.Username, &token.Access, &token.Expires)
 	if err == sql.ErrNoRows {
 		return User{}, Token{}, ErrNotFound
 	} else if err != nil {
@@ -137,6 +142,27 @@ func (users *Users) dbAuthenticateByToken(secret string) (User, Token, error) {
 
 }
 
+// SetUsername changes the username of a user, which moves their public feeds.
+func (users *Users) SetUsername(user *User, username string) error {
+	username = strings.ToLower(strings.TrimSpace(username))
+	if !usernamePattern.MatchString(username) {
+		return ErrInvalidName
+	}
+	_, err := users.db.Exec("UPDATE users SET username=$1 WHERE id=$2", username, user.ID)
+	if err != nil {
+		if isUniqueError(err) {
+			return ErrUniqueViolation
+		}
+		return fmt.Errorf("unable to set username of %v: %v", user, err)
+	}
+	user.Username = username
+	// the cached tokens hold the former username
+	if err := tokenDeleteAllFromCache(users.redis, user.ID); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
 func verifyPassword(password string, user User) bool {
 	return bcrypt.CompareHashAndPassword([]byte(user.password), []byte(password)) == nil
 }
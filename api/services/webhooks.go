@@ -0,0 +1,367 @@
+package services
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// events sent to webhooks
+const (
+	EventFeedCreated = "feed.created"
+	EventFeedUpdated = "feed.updated"
+	EventFeedDeleted = "feed.deleted"
+	EventItemAdded   = "item.added"
+	EventItemUpdated = "item.updated"
+	EventItemDeleted = "item.deleted"
+)
+
+var WebhookEvents = []string{EventFeedCreated, EventFeedUpdated, EventFeedDeleted, EventItemAdded, EventItemUpdated, EventItemDeleted}
+
+const (
+	webhookDeliveriesInterval  = 5 * time.Second
+	webhookDeliveriesBatchSize = 50
+	webhookMaxAttempts         = 8
+	webhookRetryDelay          = time.Minute
+	webhookLogRetention        = 30 * 24 * time.Hour
+	webhookLogCleanupInterval  = time.Hour
+	webhookLogSize             = 100
+)
+
+var webhookClient = &http.Client{Timeout: 15 * time.Second, Transport: guardedTransport}
+
+// Webhook is an endpoint that receives the events of a feed, or of all the
+// feeds of its owner if FeedID is empty. It receives all the events if Events
+// is empty. The secret, which signs the events, is only returned when the
+// webhook is created.
+type Webhook struct {
+	ID      RecordID  `json:"id"`
+	FeedID  RecordID  `json:"feedID,omitempty"`
+	URL     string    `json:"url"`
+	Events  []string  `json:"events"`
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// WebhookEvent is the json body posted to webhooks.
+type WebhookEvent struct {
+	ID      RecordID    `json:"id"`
+	Event   string      `json:"event"`
+	Created time.Time   `json:"created"`
+	FeedID  RecordID    `json:"feedID"`
+	Data    interface{} `json:"data"`
+}
+
+// WebhookDelivery is an attempt at sending an event to a webhook. Status is
+// pending until the event is delivered, or until it failed too many times.
+type WebhookDelivery struct {
+	ID          RecordID        `json:"id"`
+	WebhookID   RecordID        `json:"webhookID"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	LastStatus  int             `json:"lastStatus,omitempty"`
+	LastError   string          `json:"lastError,omitempty"`
+	Created     time.Time       `json:"created"`
+	LastAttempt *time.Time      `json:"lastAttempt"`
+}
+
+// the feed in feed events, without its items
+type webhookFeed struct {
+	ID          RecordID    `json:"id"`
+	Title       string      `json:"title"`
+	Link        string      `json:"link"`
+	Description string      `json:"description"`
+	Query       *SmartQuery `json:"query,omitempty"`
+}
+
+type deletedFeed struct {
+	ID RecordID `json:"id"`
+}
+
+type deletedItem struct {
+	ID     RecordID `json:"id"`
+	FeedID RecordID `json:"feedID"`
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (fs *Feeds) AddWebhook(user User, webhook *Webhook) error {
+	if webhook.FeedID != "" {
+		var exists bool
+		err := fs.db.QueryRow("SELECT true FROM feeds WHERE id=$1 AND owner_id=$2", webhook.FeedID, user.ID).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	webhook.ID = newID()
+	webhook.Secret = hex.EncodeToString(secret)
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	events, _ := json.Marshal(webhook.Events)
+
+	err := fs.db.QueryRow(`INSERT INTO webhooks(id, owner_id, feed_id, url, events, secret) VALUES($1, $2, NULLIF($3, '')::uuid, $4, $5::jsonb, $6)
+		RETURNING date_created`,
+		webhook.ID, user.ID, string(webhook.FeedID), webhook.URL, string(events), webhook.Secret).Scan(&webhook.Created)
+	if err != nil {
+		return fmt.Errorf("unable to create webhook %#v: %v", webhook, err)
+	}
+	return nil
+}
+
+func (fs *Feeds) GetWebhooks(user User) ([]Webhook, error) {
+	rows, err := fs.db.Query(`SELECT id, coalesce(feed_id::text, ''), url, events::text, date_created
+		FROM webhooks WHERE owner_id=$1 ORDER BY date_created`, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query webhooks: %v", err)
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		var events string
+		if err := rows.Scan(&webhook.ID, &webhook.FeedID, &webhook.URL, &events, &webhook.Created); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(events), &webhook.Events); err != nil {
+			return nil, fmt.Errorf("invalid events of webhook %v: %v", webhook.ID, err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (fs *Feeds) DeleteWebhook(user User, webhookID RecordID) error {
+	res, err := fs.db.Exec("DELETE FROM webhooks WHERE id=$1 AND owner_id=$2", webhookID, user.ID)
+	if err != nil {
+		return err
+	}
+	return checkRowsAffected(res, 1)
+}
+
+// GetWebhookDeliveries returns the latest deliveries of a webhook, newest first.
+func (fs *Feeds) GetWebhookDeliveries(user User, webhookID RecordID) ([]WebhookDelivery, error) {
+	rows, err := fs.db.Query(`SELECT id, webhook_id, event, payload, status, attempts, coalesce(last_status, 0),
+			coalesce(last_error, ''), date_created, last_attempt
+		FROM webhook_deliveries WHERE webhook_id=$1 AND owner_id=$2 ORDER BY date_created DESC LIMIT $3`,
+		webhookID, user.ID, webhookLogSize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query deliveries of webhook %v: %v", webhookID, err)
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var payload string
+		var lastAttempt pq.NullTime
+		err := rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts,
+			&delivery.LastStatus, &delivery.LastError, &delivery.Created, &lastAttempt)
+		if err != nil {
+			return nil, err
+		}
+		delivery.Payload = json.RawMessage(payload)
+		if lastAttempt.Valid {
+			delivery.LastAttempt = &lastAttempt.Time
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// Redeliver sends again the event of a delivery, as a new delivery.
+func (fs *Feeds) Redeliver(user User, webhookID RecordID, deliveryID RecordID) (WebhookDelivery, error) {
+	delivery := WebhookDelivery{ID: newID(), WebhookID: webhookID, Status: "pending"}
+	var payload string
+	err := fs.db.QueryRow(`INSERT INTO webhook_deliveries(id, webhook_id, owner_id, event, payload)
+		SELECT $1, webhook_id, owner_id, event, payload FROM webhook_deliveries WHERE id=$2 AND webhook_id=$3 AND owner_id=$4
+		RETURNING event, payload, date_created`,
+		delivery.ID, deliveryID, webhookID, user.ID).Scan(&delivery.Event, &payload, &delivery.Created)
+	if err == sql.ErrNoRows {
+		return WebhookDelivery{}, ErrNotFound
+	} else if err != nil {
+		return WebhookDelivery{}, err
+	}
+	delivery.Payload = json.RawMessage(payload)
+	return delivery, nil
+}
+
+// emitEvent queues the delivery of an event to the webhooks that want it.
+// Within a transaction, the deliveries are only sent if it commits. The
+// returned event is to be published to the event streams after the commit.
+func (fs *Feeds) emitEvent(db execer, user User, feedID RecordID, event string, data interface{}) (changeEvent, error) {
+	payload, err := json.Marshal(WebhookEvent{ID: newID(), Event: event, Created: time.Now().UTC(), FeedID: feedID, Data: data})
+	if err != nil {
+		return changeEvent{}, fmt.Errorf("unable to encode %v event: %v", event, err)
+	}
+	_, err = db.Exec(`INSERT INTO webhook_deliveries(id, webhook_id, owner_id, event, payload)
+		SELECT uuid_generate_v4(), id, owner_id, $3, $4 FROM webhooks
+		WHERE owner_id=$1 AND (feed_id IS NULL OR feed_id=$2) AND (events = '[]' OR events ? $3)`,
+		user.ID, feedID, event, string(payload))
+	if err != nil {
+		return changeEvent{}, fmt.Errorf("unable to queue %v event: %v", event, err)
+	}
+	return changeEvent{user: user, event: event, payload: payload}, nil
+}
+
+// emitItemsAdded queues an item.added event for each of the items added to a
+// feed at once.
+func (fs *Feeds) emitItemsAdded(db execer, user User, feedID RecordID, items []FeedItem) ([]changeEvent, error) {
+	evs := make([]changeEvent, 0, len(items))
+	for idx := range items {
+		ev, err := fs.emitEvent(db, user, feedID, EventItemAdded, &items[idx])
+		if err != nil {
+			return nil, err
+		}
+		evs = append(evs, ev)
+	}
+	return evs, nil
+}
+
+func newWebhookFeed(feed *Feed) webhookFeed {
+	return webhookFeed{ID: feed.ID, Title: feed.Title, Link: feed.Link, Description: feed.Description, Query: feed.Query}
+}
+
+func (fs *Feeds) startWebhookDeliveriesLoop(interval time.Duration) {
+	go func() {
+		tick := time.Tick(interval)
+		for range tick {
+			if err := fs.deliverDueWebhooks(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+func (fs *Feeds) startWebhookLogCleanupLoop(interval time.Duration) {
+	go func() {
+		tick := time.Tick(interval)
+		for range tick {
+			_, err := fs.db.Exec("DELETE FROM webhook_deliveries WHERE date_created < NOW() - $1 * interval '1 second'",
+				webhookLogRetention.Seconds())
+			if err != nil {
+				log.Printf("unable to delete old webhook deliveries: %v", err)
+			}
+		}
+	}()
+}
+
+type pendingDelivery struct {
+	id       RecordID
+	event    string
+	payload  string
+	attempts int
+	url      string
+	secret   string
+}
+
+func (fs *Feeds) deliverDueWebhooks() error {
+	// the due deliveries are claimed by pushing back their next attempt
+	rows, err := fs.db.Query(`UPDATE webhook_deliveries SET next_attempt = NOW() + $1 * interval '1 second'
+		FROM webhooks
+		WHERE webhooks.id = webhook_deliveries.webhook_id AND webhook_deliveries.id IN (
+			SELECT id FROM webhook_deliveries WHERE status='pending' AND next_attempt <= NOW()
+			ORDER BY next_attempt LIMIT $2 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING webhook_deliveries.id, event, payload, attempts, webhooks.url, webhooks.secret`,
+		webhookRetryDelay.Seconds(), webhookDeliveriesBatchSize)
+	if err != nil {
+		return fmt.Errorf("unable to query due webhook deliveries: %v", err)
+	}
+
+	deliveries := []pendingDelivery{}
+	for rows.Next() {
+		var d pendingDelivery
+		if err := rows.Scan(&d.id, &d.event, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			rows.Close()
+			return err
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	processClaimedRows(len(deliveries), func(idx int) {
+		fs.deliverWebhook(deliveries[idx])
+	})
+	return nil
+}
+
+func (fs *Feeds) deliverWebhook(d pendingDelivery) {
+	status, err := postWebhookEvent(d)
+	d.attempts++
+
+	var errText string
+	deliveryStatus := "delivered"
+	if err != nil {
+		errText = err.Error()
+		deliveryStatus = "pending"
+		if d.attempts >= webhookMaxAttempts {
+			deliveryStatus = "failed"
+		}
+	}
+	_, err = fs.db.Exec(`UPDATE webhook_deliveries SET status=$1, attempts=$2, last_status=NULLIF($3, 0), last_error=NULLIF($4, ''),
+			last_attempt=NOW(), next_attempt = NOW() + $5 * interval '1 second'
+		WHERE id=$6`,
+		deliveryStatus, d.attempts, status, errText, webhookBackoff(d.attempts).Seconds(), d.id)
+	if err != nil {
+		log.Printf("unable to save webhook delivery %v: %v", d.id, err)
+	}
+}
+
+// webhookBackoff is how long to wait before trying again a delivery that
+// failed attempts times.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookRetryDelay
+	for idx := 1; idx < attempts; idx++ {
+		backoff *= 2
+	}
+	return backoff
+}
+
+func postWebhookEvent(d pendingDelivery) (int, error) {
+	req, err := http.NewRequest("POST", d.url, strings.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-MyFeeds-Event", d.event)
+	req.Header.Set("X-MyFeeds-Delivery", string(d.id))
+	req.Header.Set("X-MyFeeds-Signature", "sha256="+signContent(d.secret, []byte(d.payload)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %v status", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute}
+	for idx, backoff := range expected {
+		if actual := webhookBackoff(idx + 1); actual != backoff {
+			t.Errorf("expected backoff after %v attempts to be %v, got %v", idx+1, backoff, actual)
+		}
+	}
+}
+
+func TestPostWebhookEvent(t *testing.T) {
+	defer allowLocalServers()()
+	var headers http.Header
+	var body string
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	d := pendingDelivery{id: "42", event: EventItemAdded, payload: `{"event":"item.added"}`, url: server.URL, secret: "secret"}
+	if status, err := postWebhookEvent(d); err != nil || status != http.StatusOK {
+		t.Fatalf("expected delivery to succeed, got status %v, error %v", status, err)
+	}
+	if body != d.payload {
+		t.Errorf("expected body %v, got %v", d.payload, body)
+	}
+	if headers.Get("X-MyFeeds-Event") != EventItemAdded || headers.Get("X-MyFeeds-Delivery") != "42" {
+		t.Errorf("unexpected event headers %v", headers)
+	}
+	if signature := "sha256=" + signContent("secret", []byte(d.payload)); headers.Get("X-MyFeeds-Signature") != signature {
+		t.Errorf("expected signature %v, got %v", signature, headers.Get("X-MyFeeds-Signature"))
+	}
+
+	fail = true
+	if status, err := postWebhookEvent(d); err == nil || status != http.StatusInternalServerError {
+		t.Errorf("expected delivery to fail, got status %v, error %v", status, err)
+	}
+}
+
+func TestPostWebhookEventRefusesLocalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	d := pendingDelivery{id: "42", event: EventItemAdded, payload: `{"event":"item.added"}`, url: server.URL}
+	if _, err := postWebhookEvent(d); err == nil {
+		t.Error("expected delivery to a local address to be refused")
+	}
+}
@@ -0,0 +1,345 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	websubDefaultLease       = 10 * 24 * time.Hour
+	websubMinLease           = time.Hour
+	websubMaxLease           = 30 * 24 * time.Hour
+	websubNotifyDelay        = 5 * time.Second
+	websubDeliveryAttempts   = 3
+	websubRetryDelay         = time.Minute
+	websubDeleteExpiredCheck = time.Hour
+)
+
+// the feed documents that can be subscribed to, and their content types
+var websubFormats = map[string]FeedFormat{"rss": FormatRSS, "atom": FormatAtom, "feed.json": FormatJSONFeed}
+
+var websubContentTypes = map[FeedFormat]string{
+	FormatRSS:      "application/rss+xml",
+	FormatAtom:     "application/atom+xml",
+	FormatJSONFeed: "application/feed+json",
+}
+
+var websubClient = &http.Client{Timeout: 15 * time.Second, Transport: guardedTransport}
+
+var hexRecordIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+// WebSubRequest is a subscription or unsubscription sent to the hub by a
+// feed reader.
+type WebSubRequest struct {
+	Mode         string // subscribe or unsubscribe
+	Topic        string
+	Callback     string
+	Secret       string
+	LeaseSeconds int
+}
+
+// websubTopic is what a topic, the url of a live feed document, designates
+type websubTopic struct {
+	feedID RecordID
+	format FeedFormat
+	tag    string
+	token  string
+}
+
+type websubSubscription struct {
+	topic    string
+	callback string
+	secret   string
+	lease    time.Duration
+}
+
+// websubHub sends the new content of feeds to their subscribers. Changes
+// are sent after a delay, both to coalesce bursts of changes and to let the
+// transaction they are part of commit.
+type websubHub struct {
+	mutex   sync.Mutex
+	pending map[RecordID]bool
+}
+
+func newWebSubHub() *websubHub {
+	return &websubHub{pending: map[RecordID]bool{}}
+}
+
+// parseWebSubTopic checks that topic is the url of a live feed document, as
+// advertised in the rel="self" link of the documents.
+func parseWebSubTopic(publicURL, topic string) (websubTopic, error) {
+	prefix := publicURL + "/feeds/"
+	u, err := url.Parse(topic)
+	if err != nil || publicURL == "" || !strings.HasPrefix(topic, prefix) {
+		return websubTopic{}, ErrUnknownTopic
+	}
+	parts := strings.Split(strings.TrimPrefix(strings.SplitN(topic, "?", 2)[0], prefix), "/")
+	if len(parts) != 2 || !hexRecordIDPattern.MatchString(parts[0]) {
+		return websubTopic{}, ErrUnknownTopic
+	}
+	format, ok := websubFormats[parts[1]]
+	params := u.Query()
+	if !ok || params.Get("_tok") == "" || params.Get("page") != "" {
+		return websubTopic{}, ErrUnknownTopic
+	}
+	return websubTopic{
+		feedID: RecordID(strings.ToLower(parts[0])),
+		format: format,
+		tag:    params.Get("tag"),
+		token:  params.Get("_tok"),
+	}, nil
+}
+
+// websubSecret is the secret content is signed with, which is ignored for
+// callbacks that aren't https so that it isn't sent in the clear.
+func websubSecret(req WebSubRequest) string {
+	if u, err := url.Parse(req.Callback); err != nil || u.Scheme != "https" {
+		return ""
+	}
+	return req.Secret
+}
+
+// HandleWebSubRequest checks a subscription or unsubscription request. The
+// intent of the subscriber is verified in the background, after which the
+// subscription is saved or removed.
+func (fs *Feeds) HandleWebSubRequest(req WebSubRequest) error {
+	topic, err := parseWebSubTopic(fs.config.PublicURL, req.Topic)
+	if err != nil {
+		return err
+	}
+	if ok, err := fs.websubTopicAuthorized(topic); err != nil {
+		return err
+	} else if !ok {
+		return ErrUnknownTopic
+	}
+
+	lease := time.Duration(req.LeaseSeconds) * time.Second
+	if req.LeaseSeconds <= 0 {
+		lease = websubDefaultLease
+	} else if lease < websubMinLease {
+		lease = websubMinLease
+	} else if lease > websubMaxLease {
+		lease = websubMaxLease
+	}
+
+	sub := websubSubscription{topic: req.Topic, callback: req.Callback, secret: websubSecret(req), lease: lease}
+	go func() {
+		err := verifyWebSubIntent(req.Mode, sub)
+		if err != nil {
+			log.Printf("websub %v of %v to %v not verified: %v", req.Mode, sub.callback, sub.topic, err)
+			return
+		}
+		if req.Mode == "subscribe" {
+			err = fs.saveSubscription(topic.feedID, sub)
+		} else {
+			_, err = fs.db.Exec("DELETE FROM websub_subscriptions WHERE topic=$1 AND callback=$2", sub.topic, sub.callback)
+		}
+		if err != nil {
+			log.Printf("unable to save websub %v of %v to %v: %v", req.Mode, sub.callback, sub.topic, err)
+		}
+	}()
+	return nil
+}
+
+// websubTopicAuthorized tells whether the token of a topic is a live token
+// of the owner of its feed, like the tokens the feed documents are served
+// with, so that revoking or expiring a token also ends the subscriptions made
+// with it.
+func (fs *Feeds) websubTopicAuthorized(topic websubTopic) (bool, error) {
+	var exists bool
+	err := fs.db.QueryRow(`SELECT true FROM feeds INNER JOIN access_tokens ON access_tokens.user_id = feeds.owner_id
+		WHERE feeds.id=$1 AND access_token_is_valid($2, access_tokens.*) AND (access_tokens.access & $3) <> 0`,
+		topic.feedID, topic.token, AccessRead).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to check token of topic of feed %v: %v", topic.feedID, err)
+	}
+	return true, nil
+}
+
+// verifyWebSubIntent asks the subscriber to confirm a request, by echoing a
+// random challenge.
+func verifyWebSubIntent(mode string, sub websubSubscription) error {
+	callback, err := url.Parse(sub.callback)
+	if err != nil {
+		return err
+	}
+	challengeBytes := make([]byte, 16)
+	if _, err := rand.Read(challengeBytes); err != nil {
+		return err
+	}
+	challenge := hex.EncodeToString(challengeBytes)
+
+	params := callback.Query()
+	params.Set("hub.mode", mode)
+	params.Set("hub.topic", sub.topic)
+	params.Set("hub.challenge", challenge)
+	if mode == "subscribe" {
+		params.Set("hub.lease_seconds", fmt.Sprint(int(sub.lease.Seconds())))
+	}
+	callback.RawQuery = params.Encode()
+
+	resp, err := websubClient.Get(callback.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(len(challenge))+1))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 || string(body) != challenge {
+		return fmt.Errorf("callback did not echo the challenge (status %v)", resp.StatusCode)
+	}
+	return nil
+}
+
+// saveSubscription creates a subscription, or renews its lease.
+func (fs *Feeds) saveSubscription(feedID RecordID, sub websubSubscription) error {
+	res, err := fs.db.Exec(`UPDATE websub_subscriptions SET secret=NULLIF($1, ''), lease_expires=NOW() + $2 * interval '1 second'
+		WHERE topic=$3 AND callback=$4`,
+		sub.secret, sub.lease.Seconds(), sub.topic, sub.callback)
+	if err != nil {
+		return err
+	}
+	if updated, err := res.RowsAffected(); err != nil || updated > 0 {
+		return err
+	}
+	_, err = fs.db.Exec(`INSERT INTO websub_subscriptions(id, feed_id, topic, callback, secret, lease_expires)
+		VALUES($1, $2, $3, $4, NULLIF($5, ''), NOW() + $6 * interval '1 second')`,
+		newID(), feedID, sub.topic, sub.callback, sub.secret, sub.lease.Seconds())
+	return err
+}
+
+func (fs *Feeds) startWebSubDeleteExpiredLoop(interval time.Duration) {
+	go func() {
+		tick := time.Tick(interval)
+		for range tick {
+			if _, err := fs.db.Exec("DELETE FROM websub_subscriptions WHERE lease_expires < NOW()"); err != nil {
+				log.Printf("unable to delete expired websub subscriptions: %v", err)
+			}
+		}
+	}()
+}
+
+// notifyWebSub schedules the distribution of the content of a feed that
+// changed.
+func (fs *Feeds) notifyWebSub(feedID RecordID) {
+	fs.hub.mutex.Lock()
+	defer fs.hub.mutex.Unlock()
+	if fs.hub.pending[feedID] {
+		return
+	}
+	fs.hub.pending[feedID] = true
+	time.AfterFunc(websubNotifyDelay, func() {
+		fs.hub.mutex.Lock()
+		delete(fs.hub.pending, feedID)
+		fs.hub.mutex.Unlock()
+		if err := fs.distributeWebSub(feedID); err != nil {
+			log.Printf("unable to distribute feed %v to its subscribers: %v", feedID, err)
+		}
+	})
+}
+
+func (fs *Feeds) distributeWebSub(feedID RecordID) error {
+	rows, err := fs.db.Query(`SELECT feeds.owner_id, topic, callback, coalesce(secret, '')
+		FROM websub_subscriptions INNER JOIN feeds ON feeds.id=websub_subscriptions.feed_id
+		WHERE feed_id=$1 AND lease_expires > NOW()`, feedID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var owner User
+		var sub websubSubscription
+		if err := rows.Scan(&owner.ID, &sub.topic, &sub.callback, &sub.secret); err != nil {
+			return err
+		}
+		topic, err := parseWebSubTopic(fs.config.PublicURL, sub.topic)
+		if err != nil {
+			continue
+		}
+		// the token may have been revoked or have expired since the subscription
+		if ok, err := fs.websubTopicAuthorized(topic); err != nil {
+			log.Println(err)
+			continue
+		} else if !ok {
+			if _, err := fs.db.Exec("DELETE FROM websub_subscriptions WHERE topic=$1 AND callback=$2", sub.topic, sub.callback); err != nil {
+				log.Printf("unable to delete websub subscription of %v to %v: %v", sub.callback, sub.topic, err)
+			}
+			continue
+		}
+		// the documents are most likely cached already, since all the
+		// subscribers of a topic get the same one
+		content, err := fs.Get(owner, feedID, topic.format, FeedOptions{Tag: topic.tag})
+		if err != nil {
+			log.Printf("unable to get content of topic %v: %v", sub.topic, err)
+			continue
+		}
+		go deliverWebSub(sub, websubContentTypes[topic.format], content.Bytes, fs.config.PublicURL+"/hub")
+	}
+	return rows.Err()
+}
+
+// deliverWebSub posts the content of a topic to a subscriber, retrying with
+// increasing delays if it fails.
+func deliverWebSub(sub websubSubscription, contentType string, content []byte, hubURL string) {
+	delay := websubRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := postWebSubContent(sub, contentType, content, hubURL)
+		if err == nil {
+			return
+		}
+		if attempt >= websubDeliveryAttempts {
+			log.Printf("giving up delivery of %v to %v: %v", sub.topic, sub.callback, err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func postWebSubContent(sub websubSubscription, contentType string, content []byte, hubURL string) error {
+	req, err := http.NewRequest("POST", sub.callback, strings.NewReader(string(content)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, hubURL))
+	req.Header.Add("Link", fmt.Sprintf(`<%s>; rel="self"`, sub.topic))
+	if sub.secret != "" {
+		req.Header.Set("X-Hub-Signature", "sha256="+signContent(sub.secret, content))
+	}
+
+	resp, err := websubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %v status", resp.StatusCode)
+	}
+	return nil
+}
+
+// signContent returns the hex-encoded HMAC-SHA256 of content.
+func signContent(secret string, content []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil))
+}
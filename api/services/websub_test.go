@@ -0,0 +1,78 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseWebSubTopic(t *testing.T) {
+	publicURL := "https://example.com/api/v1"
+	topic, err := parseWebSubTopic(publicURL, publicURL+"/feeds/2307EBF7548C4CB7918F680787BF4760/atom?_tok=secret&tag=go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := websubTopic{feedID: "2307ebf7548c4cb7918f680787bf4760", format: FormatAtom, tag: "go", token: "secret"}
+	if topic != expected {
+		t.Errorf("expected topic %#v, got %#v", expected, topic)
+	}
+
+	invalid := []string{
+		"https://other.example.com/api/v1/feeds/2307ebf7548c4cb7918f680787bf4760/rss?_tok=secret",
+		publicURL + "/feeds/2307ebf7548c4cb7918f680787bf4760/rss",
+		publicURL + "/feeds/2307ebf7548c4cb7918f680787bf4760/rss?_tok=secret&page=1",
+		publicURL + "/feeds/2307ebf7548c4cb7918f680787bf4760/opml?_tok=secret",
+		publicURL + "/feeds/not-an-id/rss?_tok=secret",
+	}
+	for _, link := range invalid {
+		if _, err := parseWebSubTopic(publicURL, link); err != ErrUnknownTopic {
+			t.Errorf("expected %v to be an unknown topic, got %v", link, err)
+		}
+	}
+}
+
+func TestVerifyWebSubIntent(t *testing.T) {
+	defer allowLocalServers()()
+	echo := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		if params.Get("id") != "42" || params.Get("hub.mode") != "subscribe" || params.Get("hub.lease_seconds") != "3600" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if echo {
+			fmt.Fprint(w, params.Get("hub.challenge"))
+		}
+	}))
+	defer server.Close()
+
+	sub := websubSubscription{topic: "https://example.com/topic", callback: server.URL + "/callback?id=42", lease: time.Hour}
+	if err := verifyWebSubIntent("subscribe", sub); err != nil {
+		t.Errorf("expected intent to be verified, got %v", err)
+	}
+	echo = false
+	if err := verifyWebSubIntent("subscribe", sub); err == nil {
+		t.Error("expected intent not to be verified without the challenge")
+	}
+}
+
+func TestWebSubSecret(t *testing.T) {
+	req := WebSubRequest{Callback: "https://reader.example.com/push", Secret: "secret"}
+	if secret := websubSecret(req); secret != "secret" {
+		t.Errorf("expected secret of https callback to be kept, got %q", secret)
+	}
+	req.Callback = "http://reader.example.com/push"
+	if secret := websubSecret(req); secret != "" {
+		t.Errorf("expected secret of http callback to be ignored, got %q", secret)
+	}
+}
+
+func TestSignContent(t *testing.T) {
+	// from rfc 4231, test case 2
+	expected := "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if actual := signContent("Jefe", []byte("what do ya want for nothing?")); actual != expected {
+		t.Errorf("expected signature %v, got %v", expected, actual)
+	}
+}